@@ -1,94 +1,280 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/memcachier/mc/v3"
-	"github.com/valyala/fastjson"
 )
 
+// Key/value cache that routes and street tiles are stored in.
+// Built once at cold start (see NewRouteCache) and handed to whatever needs it.
+type RouteCache interface {
+	// Get a value (false if not found)
+	Get(key string) (string, bool)
+	// Store a value for ttl seconds (0 or less to keep it until evicted)
+	Set(key string, value string, ttl int32)
+	// Get many values in as few round trips as the backend allows (missing keys are left out)
+	GetMulti(keys []string) map[string]string
+	// Store many values for ttl seconds in as few round trips as the backend allows
+	SetMulti(values map[string]string, ttl int32)
+	// Store a value for ttl seconds only if the key isn't there already (false if it was)
+	Add(key string, value string, ttl int32) bool
+	// Add delta to a counter (starting from 0), kept for ttl seconds from when it was created. Returns the new value (-1 on error).
+	Incr(key string, delta int64, ttl int32) int64
+}
+
+// Constant for the default number of memcached clients (how many single gets/sets run at once)
+const MEMCACHED_DEFAULT_POOL_SIZE int = 8
+
+// Count of background work still running, that can be waited on.
+// Unlike a sync.WaitGroup, work may be added while someone is waiting
+// (a stale route refresh being waited on stores the routes it fetches as more work).
+type backgroundWork struct {
+	mutex sync.Mutex
+	idle  *sync.Cond
+	count int
+}
+
+// Function to get a new backgroundWork with nothing running
+func newBackgroundWork() *backgroundWork {
+	work := &backgroundWork{}
+	work.idle = sync.NewCond(&work.mutex)
+	return work
+}
+
+// Function to add (or, with a negative delta, finish) work
+func (work *backgroundWork) Add(delta int) {
+	work.mutex.Lock()
+	defer work.mutex.Unlock()
+	work.count += delta
+	if work.count <= 0 {
+		work.count = 0
+		work.idle.Broadcast()
+	}
+}
+
+// Function to finish one piece of work
+func (work *backgroundWork) Done() {
+	work.Add(-1)
+}
+
+// Function to wait until no work is running
+func (work *backgroundWork) Wait() {
+	work.mutex.Lock()
+	defer work.mutex.Unlock()
+	for work.count > 0 {
+		work.idle.Wait()
+	}
+}
+
+// Cache writes still running in the background (see StoreRoutesAsync)
+var pendingCacheWrites = newBackgroundWork()
+
+// Function to wait for background cache writes to finish.
+// Call before returning from a request, as Lambda freezes the container once it returns.
+func FlushCacheWrites() {
+	pendingCacheWrites.Wait()
+}
+
+// Shared cache across every Lambda container, set up in main
+var routeCache RouteCache = NewLRUCache(LRU_DEFAULT_SIZE)
+
+// Function to pick a cache backend from the environment.
+// CACHE_BACKEND chooses "memcached", "redis" or "memory"; by default memcached is used when
+// CACHE_URL is set, Redis when REDIS_URL is set, and an in-process LRU otherwise.
+func cacheBackend() string {
+	if backend := os.Getenv("CACHE_BACKEND"); backend != "" {
+		return backend
+	}
+	if os.Getenv("CACHE_URL") != "" {
+		return "memcached"
+	}
+	if os.Getenv("REDIS_URL") != "" {
+		return "redis"
+	}
+	return "memory"
+}
+
+// Function to build the cache backend picked by cacheBackend
+func NewRouteCache() (RouteCache, error) {
+	switch backend := cacheBackend(); backend {
+	case "memcached":
+		return NewPromCache(), nil
+	case "redis":
+		return NewRedisCache(os.Getenv("REDIS_URL"))
+	case "memory":
+		return NewLRUCache(lruSize()), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", backend)
+	}
+}
+
+// Memcached cache
 type PromCache struct {
-	client *mc.Client
+	// Clients free to use (an mc.Client's key hasher isn't safe to share between goroutines)
+	clients chan *mc.Client
+	batch   *MemcachedBatcher
 }
 
 // Function to get a new PromCache instance
 func NewPromCache() *PromCache {
+	// Keep a few clients (one connection each), so single gets and sets can run side by side
+	size := MEMCACHED_DEFAULT_POOL_SIZE
+	if poolSize, err := strconv.Atoi(os.Getenv("MEMCACHED_POOL_SIZE")); err == nil && poolSize > 0 {
+		size = poolSize
+	}
+
 	// Make cache
 	cache := PromCache{
-		client: mc.NewMC(os.Getenv("CACHE_URL"), os.Getenv("MEMCACHED_USERNAME"), os.Getenv("MEMCACHED_PASSWORD")),
+		clients: make(chan *mc.Client, size),
+		batch:   NewMemcachedBatcher(os.Getenv("CACHE_URL"), os.Getenv("MEMCACHED_USERNAME"), os.Getenv("MEMCACHED_PASSWORD")),
+	}
+	for range size {
+		cache.clients <- mc.NewMCwithConfig(os.Getenv("CACHE_URL"), os.Getenv("MEMCACHED_USERNAME"), os.Getenv("MEMCACHED_PASSWORD"), mc.DefaultConfig())
 	}
 
 	// Return pointer to cache
 	return &cache
 }
 
-// Function to store Route in cache
-func (cache *PromCache) StoreRoute(prefix string, route Route, ttl int32) {
-	// Get the key for this route
-	key := fmt.Sprintf("%s_%.6f_%.6f_%.6f_%.6f",
-		prefix,
-		route.Source.Latitude,
-		route.Source.Longitude,
-		route.Destination.Latitude,
-		route.Destination.Longitude)
-
-	// Store route (length in meter, travel time in sec, traffic delay in sec)
-	routeJSON := fmt.Sprintf(`{"lengthInMeters": %d, "travelTimeInSeconds": %d, "trafficDelayInSeconds": %d, "historical": %d, "noTraffic": %d}`,
-		route.LengthInMeters,
-		route.TravelTimeInSeconds,
-		route.TrafficDelayInSeconds,
-		route.HistoricalTrafficTravelTimeInSeconds,
-		route.NoTrafficTravelTimeInSeconds)
+// Helper function to run fn with a client no other goroutine is using
+func (cache *PromCache) withClient(fn func(client *mc.Client)) {
+	client := <-cache.clients
+	defer func() { cache.clients <- client }()
+	fn(client)
+}
 
-	// Debug key
-	fmt.Printf("stored key: %s\n", key)
+// Function to get a value from memcached (false if not found)
+func (cache *PromCache) Get(key string) (string, bool) {
+	var data string
+	var err error
+	cache.withClient(func(client *mc.Client) {
+		data, _, _, err = client.Get(key)
+	})
+	if err != nil {
+		if err != mc.ErrNotFound {
+			stageLog("cache").Warn("cache error", "error", err)
+		}
+		return "", false
+	}
+	return data, true
+}
 
-	// Store in cache
-	_, err := cache.client.Set(key, routeJSON, 0, uint32(ttl), 0)
+// Function to store a value in memcached
+func (cache *PromCache) Set(key string, value string, ttl int32) {
+	var err error
+	cache.withClient(func(client *mc.Client) {
+		_, err = client.Set(key, value, 0, uint32(ttl), 0)
+	})
 	if err != nil {
-		fmt.Printf("error: %+v\n", err)
+		stageLog("cache").Warn("cache error", "error", err)
 	}
 }
 
-// Helper function to get route from JSON
-func ParseRouteJSON(routeJSON string, source Location, destination Location) *Route {
-	// Decode JSON
-	var p fastjson.Parser
-	v, err := p.Parse(routeJSON)
+// Function to store a value in memcached only if the key isn't there already.
+// Errors count as stored, so a broken cache never holds anyone off.
+func (cache *PromCache) Add(key string, value string, ttl int32) bool {
+	var err error
+	cache.withClient(func(client *mc.Client) {
+		_, err = client.Add(key, value, 0, uint32(ttl))
+	})
 	if err != nil {
-		return nil
+		if err == mc.ErrKeyExists {
+			return false
+		}
+		stageLog("cache").Warn("cache error", "error", err)
+	}
+	return true
+}
+
+// Function to add to a counter in memcached
+func (cache *PromCache) Incr(key string, delta int64, ttl int32) int64 {
+	var value uint64
+	var err error
+	cache.withClient(func(client *mc.Client) {
+		value, _, err = client.Incr(key, uint64(delta), uint64(delta), uint32(ttl), 0)
+	})
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return -1
 	}
+	return int64(value)
+}
 
-	return &Route{
-		TravelTimeInSeconds:                  v.GetInt("travelTimeInSeconds"),
-		LengthInMeters:                       v.GetInt("lengthInMeters"),
-		TrafficDelayInSeconds:                v.GetInt("trafficDelayInSeconds"),
-		HistoricalTrafficTravelTimeInSeconds: v.GetInt("historical"),
-		NoTrafficTravelTimeInSeconds:         v.GetInt("noTraffic"),
-		ArrivalTime:                          "",
-		DepartureTime:                        "",
-		Source:                               source,
-		Destination:                          destination,
+// Function to get many values from memcached, in one round trip per server (see MemcachedBatcher)
+func (cache *PromCache) GetMulti(keys []string) map[string]string {
+	values, err := cache.batch.GetMulti(keys)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
 	}
+	return values
 }
 
-// Function to retrieve Route from cache (or nil if not found)
-func (cache *PromCache) GetRoute(prefix string, source Location, destination Location) *Route {
+// Function to store many values in memcached, in one round trip per server (see MemcachedBatcher)
+func (cache *PromCache) SetMulti(values map[string]string, ttl int32) {
+	if err := cache.batch.SetMulti(values, ttl); err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+	}
+}
+
+// Function to store Route in cache (for an unknown heading at its source)
+func StoreRoute(cache RouteCache, prefix string, route Route, ttl int32) {
 	// Get the key for this route
-	key := fmt.Sprintf("%s_%.6f_%.6f_%.6f_%.6f",
-		prefix,
-		source.Latitude,
-		source.Longitude,
-		destination.Latitude,
-		destination.Longitude)
+	key := routeCacheKey(prefix, route.Source, -1, route.Destination)
 
-	// Get from cache
-	data, _, _, err := cache.client.Get(key)
-	if err != nil {
-		if err != mc.ErrNotFound {
-			fmt.Printf("error: %+v\n", err)
+	// Debug key
+	stageLog("cache").Debug("stored route", "key", key)
+
+	// Store in cache
+	cache.Set(key, routeJSON(route, time.Now().Unix()+int64(ttl)), ttl)
+}
+
+// Function to store Routes in cache in one batch, in the background.
+// headings[i] is the car's heading at routes[i]'s source (or -1 if unknown, and headings may be nil).
+// Each route is kept for its fresh + stale ttl. Use FlushCacheWrites to wait for it.
+func StoreRoutesAsync(cache RouteCache, prefix string, routes []Route, headings []float64, ttl RouteTTL) {
+	if len(routes) == 0 {
+		return
+	}
+
+	// Encode now, so the caller is free to reuse routes
+	// (grouped by ttl, as a batch shares one)
+	now := time.Now().Unix()
+	batches := make(map[int32]map[string]string)
+	for i, route := range routes {
+		fresh, stale := ttl(route)
+		if batches[fresh+stale] == nil {
+			batches[fresh+stale] = make(map[string]string)
 		}
+		batches[fresh+stale][routeCacheKey(prefix, route.Source, headingAt(headings, i), route.Destination)] = routeJSON(route, now+int64(fresh))
+	}
+
+	pendingCacheWrites.Add(1)
+	go func() {
+		defer pendingCacheWrites.Done()
+		for batchTTL, values := range batches {
+			cache.SetMulti(values, batchTTL)
+			stageLog("cache").Debug("stored routes", "prefix", prefix, "count", len(values), "ttl", batchTTL)
+		}
+	}()
+}
+
+// Helper function to get route from JSON (or nil if it isn't for close enough to source -> destination)
+func ParseRouteJSON(routeJSON string, source Location, destination Location) *Route {
+	route, _ := parseCachedRoute(routeJSON, source, destination)
+	return route
+}
+
+// Function to retrieve Route from cache, for an unknown heading at source (or nil if not found)
+func GetRoute(cache RouteCache, prefix string, source Location, destination Location) *Route {
+	// Get from cache
+	data, ok := cache.Get(routeCacheKey(prefix, source, -1, destination))
+	if !ok {
 		return nil
 	}
 
@@ -96,27 +282,76 @@ func (cache *PromCache) GetRoute(prefix string, source Location, destination Loc
 	return ParseRouteJSON(data, source, destination)
 }
 
-// Function to retrieve multiple Routes from cache (or nil if not found)
+// Function to retrieve multiple Routes from cache
+// headings[i] is the car's heading at sources[i] (or -1 if unknown, and headings may be nil).
+// Sources are told apart by index, as the same source can be asked for with different headings.
 // Returns:
-// 1. Routes from cache
-// 2. Sources not found
-// 3. Destinations not found
-func (cache *PromCache) GetRoutes(prefix string, sources []Location, destinations []Location) ([]Route, []Location, []Location) {
+// 1. The route from cache for each source (including stale ones, and the zero Route if not found)
+// 2. Indices of the sources not found
+// 3. Indices of the routes from cache that are past fresh, to be refreshed
+func GetRoutes(cache RouteCache, prefix string, sources []Location, headings []float64, destinations []Location) ([]Route, []int, []int) {
 	// Store output arrays
-	var routes []Route
-	var missedSrcs []Location
-	var missedDsts []Location
+	routes := make([]Route, len(sources))
+	var missed []int
+	var stale []int
 
-	// For each (src,dst) query the cache
+	// Query the cache for every (src,dst) at once
+	keys := make([]string, len(sources))
 	for i := range sources {
-		route := cache.GetRoute(prefix, sources[i], destinations[i])
+		keys[i] = routeCacheKey(prefix, sources[i], headingAt(headings, i), destinations[i])
+	}
+	span := startSpan("cache.get")
+	span.SetAttr("prefix", prefix)
+	values := cache.GetMulti(keys)
+	span.End()
+
+	for i := range sources {
+		var route *Route
+		fresh := false
+		if data, ok := values[keys[i]]; ok {
+			route, fresh = parseCachedRoute(data, sources[i], destinations[i])
+		}
 		if route != nil {
-			routes = append(routes, *route)
+			routes[i] = *route
+			if !fresh {
+				stale = append(stale, i)
+			}
 		} else {
-			missedSrcs = append(missedSrcs, sources[i])
-			missedDsts = append(missedDsts, destinations[i])
+			missed = append(missed, i)
 		}
 	}
 
-	return routes, missedSrcs, missedDsts
+	recordCacheLookups(prefix, len(sources)-len(missed), len(missed))
+	return routes, missed, stale
+}
+
+// Function to store the streets of one map tile in cache
+func StoreStreetTile(cache RouteCache, key string, ways []Way, ttl int32) {
+	// Encode streets
+	waysJSON, err := json.Marshal(ways)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return
+	}
+
+	// Store in cache
+	cache.Set(key, string(waysJSON), ttl)
+}
+
+// Function to retrieve the streets of one map tile from cache (false if not found)
+func GetStreetTile(cache RouteCache, key string) ([]Way, bool) {
+	// Get from cache
+	data, ok := cache.Get(key)
+	if !ok {
+		recordCacheLookups("tile", 0, 1)
+		return nil, false
+	}
+	recordCacheLookups("tile", 1, 0)
+
+	// Decode streets
+	var ways []Way
+	if err := json.Unmarshal([]byte(data), &ways); err != nil {
+		return nil, false
+	}
+	return ways, true
 }
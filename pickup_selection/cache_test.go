@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteCacheRoundTrip(t *testing.T) {
+	cache := NewLRUCache(10)
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	StoreRoute(cache, "tt", Route{LengthInMeters: 1200, TravelTimeInSeconds: 300, Source: source, Destination: destination}, 60)
+
+	route := GetRoute(cache, "tt", source, destination)
+	if route == nil || route.LengthInMeters != 1200 || route.TravelTimeInSeconds != 300 {
+		t.Fatalf("Fail: route didn't survive the cache, got %+v", route)
+	}
+	if GetRoute(cache, "ors", source, destination) != nil {
+		t.Errorf("Fail: prefixes should not share routes")
+	}
+
+	// One hit, one miss
+	routes, missed, _ := GetRoutes(cache, "tt", []Location{source, destination}, nil, []Location{destination, source})
+	if len(missed) != 1 || missed[0] != 1 || routes[0].LengthInMeters != 1200 {
+		t.Errorf("Fail: expected a hit at 0 and a miss at 1, got %+v and %v", routes, missed)
+	}
+}
+
+func TestCacheBackend(t *testing.T) {
+	t.Setenv("CACHE_BACKEND", "")
+	t.Setenv("CACHE_URL", "")
+	t.Setenv("REDIS_URL", "")
+	if backend := cacheBackend(); backend != "memory" {
+		t.Errorf("Fail: expected memory with nothing configured, got %s", backend)
+	}
+
+	t.Setenv("REDIS_URL", "localhost:6379")
+	if backend := cacheBackend(); backend != "redis" {
+		t.Errorf("Fail: expected redis, got %s", backend)
+	}
+
+	t.Setenv("CACHE_BACKEND", "bogus")
+	if _, err := NewRouteCache(); err == nil {
+		t.Errorf("Fail: expected an error for an unknown backend")
+	}
+}
+
+func TestStoreRoutesAsync(t *testing.T) {
+	cache := NewLRUCache(10)
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+
+	StoreRoutesAsync(cache, "tt", []Route{{TravelTimeInSeconds: 300, Source: source, Destination: destination}}, nil, FixedTTL(60))
+	FlushCacheWrites()
+	if route := GetRoute(cache, "tt", source, destination); route == nil || route.TravelTimeInSeconds != 300 {
+		t.Errorf("Fail: expected the route to be stored, got %+v", route)
+	}
+}
+
+// Helper function to fill memcached (a stand-in over loopback) with routes from a grid of pickups
+func benchmarkRoutes(b *testing.B) (*PromCache, []Location, []Location) {
+	address, _ := fakeMemcached(b, "", "", map[string]string{})
+	b.Setenv("CACHE_URL", address)
+	cache := NewPromCache()
+
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	var sources, destinations []Location
+	for i := 0; i < 14; i++ {
+		source := Location{Latitude: 30.6 + float64(i)*0.001, Longitude: -96.3}
+		sources = append(sources, source)
+		destinations = append(destinations, destination)
+		cache.Set(routeCacheKey("tt", source, -1, destination), routeJSON(Route{TravelTimeInSeconds: 300, Source: source, Destination: destination}, time.Now().Unix()+60), 60)
+	}
+	return cache, sources, destinations
+}
+
+// One route at a time (the old cache path)
+func BenchmarkGetRoutesSequential(b *testing.B) {
+	cache, sources, destinations := benchmarkRoutes(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range sources {
+			GetRoute(cache, "tt", sources[i], destinations[i])
+		}
+	}
+}
+
+// Every route in one multi-get
+func BenchmarkGetRoutes(b *testing.B) {
+	cache, sources, destinations := benchmarkRoutes(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		GetRoutes(cache, "tt", sources, nil, destinations)
+	}
+}
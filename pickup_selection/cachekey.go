@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Constant for the default size (in m) of the grid route origins are snapped to in cache keys
+const CACHE_DEFAULT_ORIGIN_GRID float64 = 10
+
+// Constant for how coarse the destination grid may get, as a share of the trip length
+// (being 20m off at the end of a 5mi drive changes nothing)
+const CACHE_DESTINATION_GRID_FRACTION float64 = 0.01
+
+// Constant for the coarsest grid (in m) a destination is snapped to
+const CACHE_MAX_GRID float64 = 200
+
+// Constant for how wide (in degrees) the car heading buckets in route keys are
+// (cars at the same spot facing about the same way get the same route)
+const CACHE_HEADING_BUCKET float64 = 45
+
+// Constant for meters per degree of latitude (close enough for sizing grid cells)
+const METERS_PER_DEGREE float64 = 111320
+
+// Helper function to get the origin grid size (in m) from CACHE_ORIGIN_GRID_METERS, or the default
+// (0 turns snapping off and keys use exact coordinates)
+func cacheOriginGrid() float64 {
+	size, err := strconv.ParseFloat(os.Getenv("CACHE_ORIGIN_GRID_METERS"), 64)
+	if err != nil || size < 0 {
+		return CACHE_DEFAULT_ORIGIN_GRID
+	}
+	return size
+}
+
+// Helper function to get the grid sizes (in m) a route's source and destination are snapped to.
+// The destination grid doubles from the origin grid while it stays within CACHE_DESTINATION_GRID_FRACTION
+// of the trip, so every trip of about the same length agrees on it.
+func cacheGridSizes(source Location, destination Location) (float64, float64) {
+	originGrid := cacheOriginGrid()
+	if originGrid == 0 {
+		return 0, 0
+	}
+
+	tripMeters := distanceMiles(source, destination) / MetersToMiles
+	destinationGrid := originGrid
+	for destinationGrid*2 <= math.Min(CACHE_MAX_GRID, tripMeters*CACHE_DESTINATION_GRID_FRACTION) {
+		destinationGrid *= 2
+	}
+	return originGrid, destinationGrid
+}
+
+// Helper function to get the (row, column) of the grid cell of a given size (in m) a location is in
+func gridCell(location Location, size float64) (int64, int64) {
+	// Rows are the same height everywhere, columns narrow toward the poles
+	latitudeStep := size / METERS_PER_DEGREE
+	row := int64(math.Floor(location.Latitude / latitudeStep))
+	rowLatitude := (float64(row) + 0.5) * latitudeStep
+
+	longitudeStep := latitudeStep / math.Max(math.Cos(rowLatitude*math.Pi/180), 1e-6)
+	column := int64(math.Floor(location.Longitude / longitudeStep))
+	return row, column
+}
+
+// Helper function to get the bucket (of CACHE_HEADING_BUCKET degrees, centered on north) a car's heading is in,
+// or -1 if the heading is unknown (negative)
+func headingBucket(heading float64) int {
+	if heading < 0 {
+		return -1
+	}
+	return int(math.Mod(heading+CACHE_HEADING_BUCKET/2, 360) / CACHE_HEADING_BUCKET)
+}
+
+// Helper function to get headings[i], or -1 (unknown) if there are no headings
+func headingAt(headings []float64, i int) float64 {
+	if headings == nil {
+		return -1
+	}
+	return headings[i]
+}
+
+// Helper function to get the cache key of a route.
+// Sources and destinations are snapped to grid cells, so nearby riders share drive times.
+// heading is the car's heading at source (negative if unknown, or if it doesn't matter, as for walks),
+// bucketed so a car facing the other way doesn't get a route that starts with a U-turn.
+func routeCacheKey(prefix string, source Location, heading float64, destination Location) string {
+	var key string
+	originGrid, destinationGrid := cacheGridSizes(source, destination)
+	if originGrid == 0 {
+		key = fmt.Sprintf("%s_%.6f_%.6f_%.6f_%.6f",
+			prefix,
+			source.Latitude,
+			source.Longitude,
+			destination.Latitude,
+			destination.Longitude)
+	} else {
+		sourceRow, sourceColumn := gridCell(source, originGrid)
+		destinationRow, destinationColumn := gridCell(destination, destinationGrid)
+		key = fmt.Sprintf("%s_g%g_%d_%d_g%g_%d_%d",
+			prefix,
+			originGrid,
+			sourceRow,
+			sourceColumn,
+			destinationGrid,
+			destinationRow,
+			destinationColumn)
+	}
+
+	if bucket := headingBucket(heading); bucket >= 0 {
+		key += fmt.Sprintf("_h%d", bucket)
+	}
+	return key
+}
+
+// Helper function to check a cached route was for (close enough to) the route asked for.
+// Cached routes keep their exact coordinates, which must be in the same grid cells as those asked for
+// (anywhere in a cell, so up to its diagonal apart).
+func cachedRouteMatches(cachedSource Location, cachedDestination Location, source Location, destination Location) bool {
+	// Exact keys already match to the 6th decimal
+	originGrid, destinationGrid := cacheGridSizes(source, destination)
+	if originGrid == 0 {
+		return true
+	}
+
+	cachedSourceRow, cachedSourceColumn := gridCell(cachedSource, originGrid)
+	sourceRow, sourceColumn := gridCell(source, originGrid)
+	cachedDestinationRow, cachedDestinationColumn := gridCell(cachedDestination, destinationGrid)
+	destinationRow, destinationColumn := gridCell(destination, destinationGrid)
+	return cachedSourceRow == sourceRow && cachedSourceColumn == sourceColumn &&
+		cachedDestinationRow == destinationRow && cachedDestinationColumn == destinationColumn
+}
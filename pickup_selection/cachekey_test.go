@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Helper function to move a location by some meters north and east
+func offsetMeters(location Location, north float64, east float64) Location {
+	return Location{
+		Latitude:  location.Latitude + milesToDegLatitude(north*MetersToMiles, location.Latitude),
+		Longitude: location.Longitude + milesToDegLongitude(east*MetersToMiles, location.Latitude),
+	}
+}
+
+func TestCacheGridSizes(t *testing.T) {
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+
+	// Short walk: both ends on the origin grid
+	if origin, destination := cacheGridSizes(source, offsetMeters(source, 300, 0)); origin != 10 || destination != 10 {
+		t.Errorf("Fail: expected 10m/10m, got %g/%g", origin, destination)
+	}
+
+	// ~8km drive: the destination grid doubles up to 1% of the trip
+	if _, destination := cacheGridSizes(source, offsetMeters(source, 8000, 0)); destination != 80 {
+		t.Errorf("Fail: expected an 80m destination grid, got %g", destination)
+	}
+
+	// Long drive: capped
+	if _, destination := cacheGridSizes(source, offsetMeters(source, 200000, 0)); destination != 160 {
+		t.Errorf("Fail: expected a 160m destination grid, got %g", destination)
+	}
+}
+
+func TestRouteCacheKey(t *testing.T) {
+	source := Location{Latitude: 30.60004, Longitude: -96.30004}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+
+	// 3m apart on the same grid cell share a key, 30m apart don't
+	key := routeCacheKey("tt", source, -1, destination)
+	if routeCacheKey("tt", offsetMeters(source, 3, 0), -1, destination) != key {
+		t.Errorf("Fail: expected riders 3m apart to share a key")
+	}
+	if routeCacheKey("tt", offsetMeters(source, 30, 0), -1, destination) == key {
+		t.Errorf("Fail: expected riders 30m apart not to share a key")
+	}
+
+	// Cars facing about the same way share a key, cars facing other ways don't (and unknown is its own key)
+	north := routeCacheKey("tt", source, 10, destination)
+	if north == key || routeCacheKey("tt", source, 350, destination) != north {
+		t.Errorf("Fail: expected headings 10 and 350 to share a key apart from unknown")
+	}
+	if routeCacheKey("tt", source, 180, destination) == north || routeCacheKey("tt", source, 90, destination) == north {
+		t.Errorf("Fail: expected cars facing east or south not to share a key with north")
+	}
+
+	// Snapping can be turned off
+	t.Setenv("CACHE_ORIGIN_GRID_METERS", "0")
+	if key := routeCacheKey("tt", source, -1, destination); key != "tt_30.600040_-96.300040_30.700000_-96.400000" {
+		t.Errorf("Fail: expected an exact key, got %s", key)
+	}
+}
+
+func TestRouteCacheValidation(t *testing.T) {
+	cache := NewLRUCache(10)
+	source := Location{Latitude: 30.60004, Longitude: -96.30004}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	StoreRoute(cache, "tt", Route{TravelTimeInSeconds: 300, Source: source, Destination: destination}, 60)
+
+	// A rider 3m away reuses the route (but keeps their own coordinates)
+	nearby := offsetMeters(source, 3, 0)
+	route := GetRoute(cache, "tt", nearby, destination)
+	if route == nil || route.Source != nearby {
+		t.Fatalf("Fail: expected the route to be reused for %+v, got %+v", nearby, route)
+	}
+
+	// So does a rider across the cell, further than the grid size but still under the same key
+	row, column := gridCell(source, CACHE_DEFAULT_ORIGIN_GRID)
+	latitudeStep := CACHE_DEFAULT_ORIGIN_GRID / METERS_PER_DEGREE
+	longitudeStep := latitudeStep / math.Cos((float64(row)+0.5)*latitudeStep*math.Pi/180)
+	corner := Location{Latitude: (float64(row) + 0.05) * latitudeStep, Longitude: (float64(column) + 0.05) * longitudeStep}
+	opposite := Location{Latitude: (float64(row) + 0.95) * latitudeStep, Longitude: (float64(column) + 0.95) * longitudeStep}
+	StoreRoute(cache, "tt", Route{TravelTimeInSeconds: 300, Source: corner, Destination: destination}, 60)
+	if distanceMiles(corner, opposite) <= CACHE_DEFAULT_ORIGIN_GRID*MetersToMiles {
+		t.Fatalf("Fail: expected the corners further apart than the grid size")
+	}
+	if route := GetRoute(cache, "tt", opposite, destination); route == nil {
+		t.Errorf("Fail: expected the route to be reused across the cell")
+	}
+
+	// An entry under the right key with the wrong coordinates is a miss
+	key := routeCacheKey("tt", source, -1, destination)
+	cache.Set(key, routeJSON(Route{Source: Location{Latitude: 1, Longitude: 1}, Destination: destination}, time.Now().Unix()+60), 60)
+	if GetRoute(cache, "tt", source, destination) != nil {
+		t.Errorf("Fail: expected a mismatched entry to be a miss")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Constant for how long a container's in-flight marker holds other containers off a route (in sec)
+const INFLIGHT_TTL int32 = 5
+
+// Constant for how long to wait on a route another container is fetching before fetching it ourselves
+const INFLIGHT_WAIT time.Duration = 2 * time.Second
+
+// Constant for how often to check the cache for a route another container is fetching
+const INFLIGHT_POLL time.Duration = 100 * time.Millisecond
+
+// One upstream call, shared by every request that wants its result
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// Requests in flight in this container, so concurrent requests for the same thing only make one upstream call
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Function to get a new, empty flightGroup
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Upstream calls in flight in this container
+var tomtomFlights = newFlightGroup()
+var orsFlights = newFlightGroup()
+var overpassFlights = newFlightGroup()
+
+// Function to run fn once for every concurrent caller with the same key.
+// Callers that come in while it's running wait for it and get the same result.
+func (group *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	calls, owned := group.claim([]string{key})
+	if !owned[0] {
+		<-calls[0].done
+		return calls[0].value, calls[0].err
+	}
+
+	value, err := fn()
+	group.finish(key, calls[0], value, err)
+	return value, err
+}
+
+// Helper function to claim many keys at once.
+// Returns the call for each key, and whether this caller owns it (and must finish it) or should wait on it.
+// A key repeated in keys is only owned once.
+func (group *flightGroup) claim(keys []string) ([]*flightCall, []bool) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	calls := make([]*flightCall, len(keys))
+	owned := make([]bool, len(keys))
+	for i, key := range keys {
+		if call, ok := group.calls[key]; ok {
+			calls[i] = call
+			continue
+		}
+		calls[i] = &flightCall{done: make(chan struct{})}
+		owned[i] = true
+		group.calls[key] = calls[i]
+	}
+	return calls, owned
+}
+
+// Helper function to hand an owned call's result to everyone waiting on it
+func (group *flightGroup) finish(key string, call *flightCall, value interface{}, err error) {
+	group.mutex.Lock()
+	delete(group.calls, key)
+	group.mutex.Unlock()
+
+	call.value = value
+	call.err = err
+	close(call.done)
+}
+
+// Helper function to mark a route as being fetched in the shared cache.
+// Returns false if another container already is.
+func claimInFlight(cache RouteCache, key string) bool {
+	return cache.Add("inflight_"+key, "1", INFLIGHT_TTL)
+}
+
+// Helper function to get the sources (and their headings, -1 if unknown) at indices
+func sourcesAt(sources []Location, headings []float64, indices []int) ([]Location, []float64) {
+	picked := make([]Location, len(indices))
+	pickedHeadings := make([]float64, len(indices))
+	for k, i := range indices {
+		picked[k] = sources[i]
+		pickedHeadings[k] = headingAt(headings, i)
+	}
+	return picked, pickedHeadings
+}
+
+// Helper function to wait (up to INFLIGHT_WAIT) for routes other containers are fetching to show up in cache.
+// headings[i] is the car's heading at sources[i] (or -1 if unknown, and headings may be nil).
+// Returns the route for each source that did (nil for the rest).
+func awaitCachedRoutes(cache RouteCache, prefix string, sources []Location, headings []float64, destination Location) []*Route {
+	found := make([]*Route, len(sources))
+	deadline := time.Now().Add(INFLIGHT_WAIT)
+	for {
+		// Look for the ones still missing
+		var missing []int
+		for i := range sources {
+			if found[i] == nil {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 || time.Now().After(deadline) {
+			return found
+		}
+
+		missingSources, missingHeadings := sourcesAt(sources, headings, missing)
+		destinations := make([]Location, len(missing))
+		for k := range destinations {
+			destinations[k] = destination
+		}
+		routes, missed, _ := GetRoutes(cache, prefix, missingSources, missingHeadings, destinations)
+		stillMissing := make([]bool, len(missing))
+		for _, k := range missed {
+			stillMissing[k] = true
+		}
+		for k, i := range missing {
+			if !stillMissing[k] {
+				route := routes[k]
+				found[i] = &route
+			}
+		}
+		if len(missed) > 0 {
+			time.Sleep(INFLIGHT_POLL)
+		}
+	}
+}
+
+// Helper function to put fetched routes in place: routes[k] is for the source at indices[k], if routed[k]
+func fillFetched(results []*Route, indices []int, routes []Route, routed []bool) {
+	for k, i := range indices {
+		if k < len(routed) && routed[k] {
+			route := routes[k]
+			results[i] = &route
+		}
+	}
+}
+
+// Function to fetch routes from sources to destination, collapsing duplicate work.
+// Routes another request in this container is fetching are waited on, routes another container is fetching
+// (see claimInFlight) are waited on for a little while, and fetch is only called for the rest.
+// fetch must store what it fetches in cache, so other containers can pick it up, and returns a route for
+// each source it's handed (with its heading), and whether it could get it.
+// headings[i] is the car's heading at sources[i] (or -1 if unknown, and headings may be nil).
+// Returns a route for each source, in order (nil if it couldn't be fetched).
+func coalesceRoutes(cache RouteCache, prefix string, group *flightGroup, sources []Location, headings []float64, destination Location, fetch func(sources []Location, headings []float64) ([]Route, []bool)) []*Route {
+	// Step 1. Claim the routes no other request in this container is fetching
+	keys := make([]string, len(sources))
+	for i, source := range sources {
+		keys[i] = routeCacheKey(prefix, source, headingAt(headings, i), destination)
+	}
+	calls, owned := group.claim(keys)
+	results := make([]*Route, len(sources))
+
+	// Step 2. Leave the ones another container is fetching to it, for a little while
+	var mine, theirs []int
+	for i := range sources {
+		if !owned[i] {
+			continue
+		}
+		if claimInFlight(cache, keys[i]) {
+			mine = append(mine, i)
+		} else {
+			theirs = append(theirs, i)
+		}
+	}
+	if len(theirs) > 0 {
+		stageLog(prefix).Info("waiting on routes in flight elsewhere", "count", len(theirs))
+		theirSources, theirHeadings := sourcesAt(sources, headings, theirs)
+		found := awaitCachedRoutes(cache, prefix, theirSources, theirHeadings, destination)
+		for k, i := range theirs {
+			if found[k] != nil {
+				results[i] = found[k]
+			} else {
+				mine = append(mine, i)
+			}
+		}
+	}
+
+	// Step 3. Fetch the rest
+	if len(mine) > 0 {
+		routes, routed := fetch(sourcesAt(sources, headings, mine))
+		fillFetched(results, mine, routes, routed)
+	}
+
+	// Step 4. Hand them to the requests in this container waiting on them
+	for i := range sources {
+		if owned[i] {
+			group.finish(keys[i], calls[i], results[i], nil)
+		}
+	}
+
+	// Step 5. Wait on the routes other requests in this container were fetching
+	// (fetching them ourselves if that failed)
+	var retry []int
+	for i := range sources {
+		if owned[i] {
+			continue
+		}
+		<-calls[i].done
+		if route, ok := calls[i].value.(*Route); ok && route != nil {
+			shared := *route
+			shared.Source = sources[i]
+			shared.Destination = destination
+			results[i] = &shared
+		} else {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) > 0 {
+		routes, routed := fetch(sourcesAt(sources, headings, retry))
+		fillFetched(results, retry, routes, routed)
+	}
+
+	return results
+}
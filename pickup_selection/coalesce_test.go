@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupDo(t *testing.T) {
+	group := newFlightGroup()
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	// Everyone asks for the same thing while the first call is still running
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = group.Do("key", func() (interface{}, error) {
+				calls.Add(1)
+				<-release
+				return "value", nil
+			})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Fail: expected 1 call, got %d", calls.Load())
+	}
+	for i, result := range results {
+		if result != "value" {
+			t.Errorf("Fail: expected caller %d to get the shared value, got %v", i, result)
+		}
+	}
+}
+
+func TestCoalesceRoutes(t *testing.T) {
+	t.Setenv("CACHE_ORIGIN_GRID_METERS", "0")
+	cache := NewLRUCache(100)
+	group := newFlightGroup()
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	a := Location{Latitude: 30.6, Longitude: -96.3}
+	b := Location{Latitude: 30.61, Longitude: -96.3}
+	c := Location{Latitude: 30.62, Longitude: -96.3}
+
+	// Count fetches per source, holding the first fetch until the second request is waiting on it
+	var mutex sync.Mutex
+	fetches := make(map[Location]int)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	fetch := func(sources []Location, headings []float64) ([]Route, []bool) {
+		mutex.Lock()
+		for _, source := range sources {
+			fetches[source]++
+		}
+		mutex.Unlock()
+		started <- struct{}{}
+		<-release
+
+		routes := make([]Route, len(sources))
+		routed := make([]bool, len(sources))
+		for i, source := range sources {
+			routes[i] = Route{TravelTimeInSeconds: 300, Source: source, Destination: destination}
+			routed[i] = true
+		}
+		return routes, routed
+	}
+
+	var first, second []*Route
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first = coalesceRoutes(cache, "tt", group, []Location{a, b}, nil, destination, fetch)
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		second = coalesceRoutes(cache, "tt", group, []Location{b, c}, nil, destination, fetch)
+	}()
+	<-started
+	close(release)
+	wg.Wait()
+
+	if fetches[a] != 1 || fetches[b] != 1 || fetches[c] != 1 {
+		t.Errorf("Fail: expected every route fetched once, got %v", fetches)
+	}
+	if len(first) != 2 || len(second) != 2 || first[0] == nil || first[1] == nil || second[0] == nil || second[1] == nil || second[0].Source != b || second[1].Source != c {
+		t.Errorf("Fail: expected both requests to get their routes, got %+v and %+v", first, second)
+	}
+}
+
+func TestCoalesceRoutesInFlightElsewhere(t *testing.T) {
+	t.Setenv("CACHE_ORIGIN_GRID_METERS", "0")
+	cache := NewLRUCache(100)
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+
+	// Another container is fetching the route, and stores it shortly
+	if !claimInFlight(cache, routeCacheKey("tt", source, -1, destination)) {
+		t.Fatalf("Fail: expected to claim the route")
+	}
+	go func() {
+		time.Sleep(2 * INFLIGHT_POLL)
+		StoreRoute(cache, "tt", Route{TravelTimeInSeconds: 300, Source: source, Destination: destination}, 60)
+	}()
+
+	routes := coalesceRoutes(cache, "tt", newFlightGroup(), []Location{source}, nil, destination, func(sources []Location, headings []float64) ([]Route, []bool) {
+		t.Errorf("Fail: expected no fetch for a route in flight elsewhere")
+		return nil, nil
+	})
+	if len(routes) != 1 || routes[0] == nil || routes[0].TravelTimeInSeconds != 300 {
+		t.Errorf("Fail: expected the other container's route, got %+v", routes)
+	}
+}
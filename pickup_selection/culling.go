@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Constants for weighting what makes a good pickup when culling a ring
+// (progress is -1..1 toward the destination, road class is 0..1 from scoreWay)
+const CULL_PROGRESS_WEIGHT float64 = 1.0
+const CULL_ROAD_WEIGHT float64 = 0.5
+const CULL_SPACING_WEIGHT float64 = 1.0
+
+// Constant for how close (in mi) two kept pickups can get before they start being penalized
+const CULL_MIN_SPACING float64 = 0.1
+
+// Constant for the share of a ring's segments that go to the half facing the destination
+const CULL_FRONT_SHARE float64 = 2.0 / 3
+
+// Helper function to split a ring's segments between the halves facing toward and away from the destination
+func splitSegments(numberSegments int) (int, int) {
+	if numberSegments < 2 {
+		return numberSegments, 0
+	}
+	front := int(math.Round(float64(numberSegments) * CULL_FRONT_SHARE))
+	front = max(1, min(numberSegments-1, front))
+	return front, numberSegments - front
+}
+
+// Helper function to get the segment of a point at relative bearing (in degrees, 0 = toward the destination)
+// The front half (-90..90) is split into front segments, the back half into back segments.
+func segmentFor(relative float64, front int, back int) int {
+	// Wrap to [-180, 180)
+	relative = math.Mod(relative+540, 360) - 180
+
+	// Only one segment, so nothing to split
+	if back == 0 {
+		return 0
+	}
+
+	if relative >= -90 && relative < 90 {
+		return min(front-1, int((relative+90)/(180/float64(front))))
+	}
+	behind := math.Mod(relative-90+360, 360)
+	return front + min(back-1, int(behind/(180/float64(back))))
+}
+
+// Cull a ring's pickups, keeping the best pointsPerSegment in each segment.
+// Points are scored by how far they lead toward the destination, how good a street they're on (roadScores),
+// and how far they are from the pickups already kept. Ties go to the southernmost, then westernmost point,
+// so the result doesn't depend on input order. The half facing the destination gets more segments.
+// Returns the kept points and their road scores.
+func cullTowardDestination(points []Location, roadScores []float64, center Location, destination Location, numberSegments int, pointsPerSegment int) ([]Location, []float64) {
+	// Step 0. Ignore empty points
+	if len(points) == 0 || numberSegments < 1 {
+		return []Location{}, []float64{}
+	}
+
+	// Step 1. Work out which way the destination is (straight north if it's on top of us)
+	toDestination := 0.0
+	hasDirection := distanceMiles(center, destination) > 0
+	if hasDirection {
+		toDestination = bearingDegrees(center, destination)
+	}
+
+	// Step 2. Find each point's segment and progress toward the destination (scaled to the ring size)
+	front, back := splitSegments(numberSegments)
+	radius := 0.0
+	for _, point := range points {
+		radius = math.Max(radius, distanceMiles(center, point))
+	}
+	segments := make([]int, len(points))
+	progress := make([]float64, len(points))
+	for i, point := range points {
+		relative := bearingDegrees(center, point) - toDestination
+		segments[i] = segmentFor(relative, front, back)
+		if hasDirection && radius > 0 {
+			progress[i] = math.Cos(relative*math.Pi/180) * distanceMiles(center, point) / radius
+		}
+	}
+
+	// Step 3. Put points in a fixed order for tie-breaking
+	order := make([]int, len(points))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := points[order[i]], points[order[j]]
+		if a.Latitude != b.Latitude {
+			return a.Latitude < b.Latitude
+		}
+		return a.Longitude < b.Longitude
+	})
+
+	// Step 4. Greedily keep the best remaining point until every segment is full
+	kept := []Location{}
+	keptScores := []float64{}
+	used := make([]bool, len(points))
+	counts := make([]int, numberSegments)
+	for {
+		best := -1
+		bestScore := math.Inf(-1)
+		for _, i := range order {
+			if used[i] || counts[segments[i]] >= pointsPerSegment {
+				continue
+			}
+
+			// Penalize crowding the pickups already kept
+			crowding := 0.0
+			for _, other := range kept {
+				crowding = math.Max(crowding, 1-distanceMiles(points[i], other)/CULL_MIN_SPACING)
+			}
+
+			score := CULL_PROGRESS_WEIGHT*progress[i] + CULL_ROAD_WEIGHT*roadScores[i] - CULL_SPACING_WEIGHT*crowding
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		used[best] = true
+		counts[segments[best]]++
+		kept = append(kept, points[best])
+		keptScores = append(keptScores, roadScores[best])
+	}
+
+	return kept, keptScores
+}
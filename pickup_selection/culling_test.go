@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestSplitSegments(t *testing.T) {
+	for _, test := range []struct{ segments, front, back int }{
+		{1, 1, 0}, {2, 1, 1}, {3, 2, 1}, {4, 3, 1}, {6, 4, 2},
+	} {
+		front, back := splitSegments(test.segments)
+		if front != test.front || back != test.back {
+			t.Errorf("Fail: %d segments split into %d/%d, expected %d/%d", test.segments, front, back, test.front, test.back)
+		}
+	}
+}
+
+func TestCullTowardDestination(t *testing.T) {
+	center := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.3}
+	at := func(north float64, east float64) Location {
+		return Location{
+			Latitude:  center.Latitude + milesToDegLatitude(north, center.Latitude),
+			Longitude: center.Longitude + milesToDegLongitude(east, center.Latitude),
+		}
+	}
+
+	// Two points ahead on the same side, one on a better street, and one behind
+	ahead := at(0.5, 0.01)
+	aheadBetterStreet := at(0.49, 0.1)
+	behind := at(-0.5, 0)
+	points := []Location{behind, ahead, aheadBetterStreet}
+	scores := []float64{1, 0.4, 1}
+
+	// 2 segments: one ahead, one behind
+	culled, culledScores := cullTowardDestination(points, scores, center, destination, 2, 1)
+	if len(culled) != 2 || culled[0] != aheadBetterStreet || culled[1] != behind {
+		t.Errorf("Fail: expected the better street ahead then the point behind, got %+v", culled)
+	}
+	if len(culledScores) != 2 || culledScores[0] != 1 {
+		t.Errorf("Fail: expected the kept points' road scores, got %v", culledScores)
+	}
+
+	// Input order doesn't matter
+	reversed, _ := cullTowardDestination([]Location{aheadBetterStreet, ahead, behind}, []float64{1, 0.4, 1}, center, destination, 2, 1)
+	if len(reversed) != len(culled) || reversed[0] != culled[0] || reversed[1] != culled[1] {
+		t.Errorf("Fail: result depends on input order, got %+v and %+v", culled, reversed)
+	}
+
+	// Ties go to the southernmost, then westernmost point, whatever the input order
+	// (with the destination on top of us there's no progress to break them, so every point scores the same)
+	southWest := at(-0.5, -0.3)
+	southEast := at(-0.5, 0.3)
+	northWest := at(0.5, -0.6)
+	for _, order := range [][]Location{{southEast, northWest, southWest}, {southWest, southEast, northWest}, {northWest, southWest, southEast}} {
+		tied, _ := cullTowardDestination(order, []float64{1, 1, 1}, center, center, 1, 1)
+		if len(tied) != 1 || tied[0] != southWest {
+			t.Errorf("Fail: expected the southwestern point %+v to win the tie, got %+v", southWest, tied)
+		}
+	}
+}
+
+func TestCullTowardDestinationAcrossAntimeridian(t *testing.T) {
+	// Fiji: the destination is a few miles east, across 180
+	center := Location{Latitude: -17, Longitude: 179.99}
+	destination := Location{Latitude: -17, Longitude: -179.95}
+	east := Location{Latitude: -17, Longitude: -179.995}
+	west := Location{Latitude: -17, Longitude: 179.975}
+
+	// The point across 180 is the one leading toward the destination
+	culled, _ := cullTowardDestination([]Location{west, east}, []float64{1, 1}, center, destination, 1, 1)
+	if len(culled) != 1 || culled[0] != east {
+		t.Errorf("Fail: expected the point across the antimeridian, got %+v", culled)
+	}
+
+	// And it's ahead, with the other behind
+	culled, _ = cullTowardDestination([]Location{west, east}, []float64{1, 1}, center, destination, 2, 1)
+	if len(culled) != 2 || culled[0] != east || culled[1] != west {
+		t.Errorf("Fail: expected one point ahead and one behind, got %+v", culled)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// Constant for how far to keep pickups back from an intersection (in mi, ~50ft)
+const CURB_INTERSECTION_SETBACK float64 = 0.01
+
+// Constant for the furthest a pickup may be shifted along its street (in mi, ~250ft)
+const CURB_MAX_SHIFT float64 = 0.05
+
+// Values of parking:* tags that forbid pulling over
+var CURB_NO_STOPPING_VALUES []string = []string{"no_stopping", "no_standing"}
+
+// Returns whether a car may pull over anywhere along a way, judging by its OSM tags
+func isStoppingAllowed(tags map[string]string) bool {
+	// Bridges and tunnels have no shoulder to pull onto
+	if value, ok := tags["bridge"]; ok && value != "no" {
+		return false
+	}
+	if value, ok := tags["tunnel"]; ok && value != "no" {
+		return false
+	}
+
+	// Roundabouts and other junction ways are the intersection itself
+	if value, ok := tags["junction"]; ok && value != "no" {
+		return false
+	}
+
+	// Highway ramps (motorway_link, primary_link, ...)
+	if strings.HasSuffix(tags["highway"], "_link") {
+		return false
+	}
+
+	// Private or closed roads
+	if tags["access"] == "no" || tags["access"] == "private" {
+		return false
+	}
+
+	// Explicit stopping restrictions (on both sides, or each side; see isStoppingAllowedOn for one side)
+	if tags["no_stopping"] == "yes" || !isStoppingAllowedOn(tags, "both") {
+		return false
+	}
+	if !isStoppingAllowedOn(tags, "left") && !isStoppingAllowedOn(tags, "right") {
+		return false
+	}
+	for _, value := range CURB_NO_STOPPING_VALUES {
+		if tags["parking:lane"] == value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns whether a car may pull over on one side of a way ("left" or "right" in the order of its nodes, or "both"),
+// judging by the parking:lane:<side>, parking:<side> and parking:<side>:restriction tags
+func isStoppingAllowedOn(tags map[string]string, side string) bool {
+	for _, key := range []string{"parking:lane:" + side, "parking:" + side, "parking:" + side + ":restriction"} {
+		for _, value := range CURB_NO_STOPPING_VALUES {
+			if tags[key] == value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the set of nodes shared by two or more ways (i.e. intersections)
+func findIntersectionNodes(ways []Way) map[Location]bool {
+	// Count how many ways touch each node
+	counts := make(map[Location]int)
+	for _, way := range ways {
+		// Only count a node once per way (loops repeat their first node)
+		seen := make(map[Location]bool)
+		for _, node := range way.Geometry {
+			if seen[node] {
+				continue
+			}
+			seen[node] = true
+			counts[node]++
+		}
+	}
+
+	// Keep the shared nodes
+	intersections := make(map[Location]bool)
+	for node, count := range counts {
+		if count >= 2 {
+			intersections[node] = true
+		}
+	}
+
+	return intersections
+}
+
+// Helper function to find how far along a way (in mi) the closest point to location is
+func projectOntoWay(location Location, way Way) float64 {
+	bestDistance := math.Inf(1)
+	bestPosition := 0.0
+	traveled := 0.0
+
+	for i := range way.Geometry[:len(way.Geometry)-1] {
+		a := way.Geometry[i]
+		b := way.Geometry[i+1]
+
+		// Work in a local frame (in mi) centered on a
+		bx := (b.Longitude - a.Longitude) / milesToDegLongitude(1, a.Latitude)
+		by := (b.Latitude - a.Latitude) / milesToDegLatitude(1, a.Latitude)
+		px := (location.Longitude - a.Longitude) / milesToDegLongitude(1, a.Latitude)
+		py := (location.Latitude - a.Latitude) / milesToDegLatitude(1, a.Latitude)
+
+		// Project onto the segment, clamped to its ends
+		t := 0.0
+		if bx != 0 || by != 0 {
+			t = math.Max(0, math.Min(1, (px*bx+py*by)/(bx*bx+by*by)))
+		}
+
+		// Keep the closest segment
+		distance := math.Hypot(px-bx*t, py-by*t)
+		if distance < bestDistance {
+			bestDistance = distance
+			bestPosition = traveled + t*distanceMiles(a, b)
+		}
+
+		traveled += distanceMiles(a, b)
+	}
+
+	return bestPosition
+}
+
+// Helper function to get the location a given distance (in mi) along a way
+func locationAlongWay(way Way, position float64) Location {
+	traveled := 0.0
+	for i := range way.Geometry[:len(way.Geometry)-1] {
+		a := way.Geometry[i]
+		b := way.Geometry[i+1]
+		length := distanceMiles(a, b)
+
+		if length > 0 && traveled+length >= position {
+			return interpolateLocation(a, b, (position-traveled)/length)
+		}
+
+		traveled += length
+	}
+
+	return way.Geometry[len(way.Geometry)-1]
+}
+
+// Snap a candidate pickup point on a way to the nearest spot a car can legally pull over.
+// Points too close to an intersection are shifted along the same way (downstream on one-ways).
+// Returns false if the way forbids stopping or no legal spot is within CURB_MAX_SHIFT.
+func snapToCurbside(point Location, way Way, intersections map[Location]bool) (Location, bool) {
+	// Step 0. Ignore degenerate ways
+	if len(way.Geometry) < 2 {
+		return Location{}, false
+	}
+
+	// Step 1. Reject ways where stopping is never allowed
+	if !isStoppingAllowed(way.Tags) {
+		return Location{}, false
+	}
+
+	// Step 2. Find the point's position along the way
+	position := projectOntoWay(point, way)
+
+	// Step 3. Build forbidden intervals around each intersection on this way
+	var forbidden [][2]float64
+	traveled := 0.0
+	for i, node := range way.Geometry {
+		if i > 0 {
+			traveled += distanceMiles(way.Geometry[i-1], node)
+		}
+		if intersections[node] {
+			forbidden = append(forbidden, [2]float64{traveled - CURB_INTERSECTION_SETBACK, traveled + CURB_INTERSECTION_SETBACK})
+		}
+	}
+	length := traveled
+
+	// Step 4. Collect possible stopping positions (the point itself + the edge of each interval)
+	options := []float64{position}
+	for _, interval := range forbidden {
+		options = append(options, interval[0], interval[1])
+	}
+
+	// Step 5. Pick the closest legal option, preferring the direction of travel on one-ways
+	direction := float64(way.Oneway)
+
+	bestCost := math.Inf(1)
+	bestPosition := 0.0
+	for _, option := range options {
+		// Must stay on the way and within the maximum shift
+		shift := option - position
+		if option < 0 || option > length || math.Abs(shift) > CURB_MAX_SHIFT {
+			continue
+		}
+
+		// Must not be inside any forbidden interval
+		legal := true
+		for _, interval := range forbidden {
+			if option > interval[0] && option < interval[1] {
+				legal = false
+				break
+			}
+		}
+		if !legal {
+			continue
+		}
+
+		// Backing up against a one-way costs an extra full shift
+		cost := math.Abs(shift)
+		if shift*direction < 0 {
+			cost += CURB_MAX_SHIFT
+		}
+
+		if cost < bestCost {
+			bestCost = cost
+			bestPosition = option
+		}
+	}
+
+	if math.IsInf(bestCost, 1) {
+		return Location{}, false
+	}
+
+	// Step 6. Convert back into a location
+	if bestPosition == position {
+		return point, true
+	}
+	return locationAlongWay(way, bestPosition), true
+}
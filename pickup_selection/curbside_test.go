@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestIsStoppingAllowed(t *testing.T) {
+	if !isStoppingAllowed(map[string]string{"highway": "residential"}) {
+		t.Errorf("Fail: residential street should allow stopping")
+	}
+	if isStoppingAllowed(map[string]string{"highway": "primary", "bridge": "yes"}) {
+		t.Errorf("Fail: bridge should not allow stopping")
+	}
+	if isStoppingAllowed(map[string]string{"highway": "primary_link"}) {
+		t.Errorf("Fail: ramp should not allow stopping")
+	}
+	if isStoppingAllowed(map[string]string{"highway": "tertiary", "parking:lane:both": "no_stopping"}) {
+		t.Errorf("Fail: no_stopping street should not allow stopping")
+	}
+
+	// One side's restrictions only forbid that side
+	for _, tags := range []map[string]string{
+		{"parking:lane:right": "no_stopping"},
+		{"parking:right": "no_stopping"},
+		{"parking:right:restriction": "no_standing"},
+	} {
+		if !isStoppingAllowed(tags) || isStoppingAllowedOn(tags, "right") || !isStoppingAllowedOn(tags, "left") {
+			t.Errorf("Fail: expected only the right side forbidden by %v", tags)
+		}
+	}
+	if isStoppingAllowed(map[string]string{"parking:lane:left": "no_stopping", "parking:right:restriction": "no_stopping"}) {
+		t.Errorf("Fail: street with no stopping on either side should not allow stopping")
+	}
+}
+
+func TestSnapToCurbside(t *testing.T) {
+	// A 0.1mi east-west street, crossed by another street at its west end
+	west := Location{Latitude: 30.6, Longitude: -96.3}
+	east := Location{Latitude: 30.6, Longitude: -96.3 + milesToDegLongitude(0.1, 30.6)}
+	way := Way{Geometry: []Location{west, east}, Tags: map[string]string{"highway": "residential"}}
+	intersections := map[Location]bool{west: true}
+
+	// A point right at the intersection is moved east by the setback
+	point := interpolateLocation(west, east, 0.02)
+	snapped, ok := snapToCurbside(point, way, intersections)
+	if !ok {
+		t.Fatalf("Fail: expected a legal pickup near the intersection")
+	}
+	distance := distanceMiles(west, snapped)
+	if distance < CURB_INTERSECTION_SETBACK*0.99 || distance > CURB_INTERSECTION_SETBACK*1.01 {
+		t.Errorf("Fail: expected pickup %f mi from intersection, got %f", CURB_INTERSECTION_SETBACK, distance)
+	}
+
+	// A point mid-block is left alone
+	point = interpolateLocation(west, east, 0.5)
+	snapped, ok = snapToCurbside(point, way, intersections)
+	if !ok || snapped != point {
+		t.Errorf("Fail: mid-block pickup should not move, got %+v", snapped)
+	}
+
+	// A bridge is rejected outright
+	way.Tags["bridge"] = "yes"
+	if _, ok := snapToCurbside(point, way, intersections); ok {
+		t.Errorf("Fail: pickup on a bridge should be rejected")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Constant for the default closest two pickups may be (in mi, ~30m) before they count as the same spot
+const PICKUP_MIN_SPACING float64 = 0.02
+
+// One ring's culled pickups, with how good a street each is on
+type ringPickups struct {
+	Ring   int
+	Points []Location
+	Scores []float64
+}
+
+// Helper function to get the minimum pickup spacing (in mi) from PICKUP_MIN_SPACING, or the default
+func pickupMinSpacing() float64 {
+	spacing, err := strconv.ParseFloat(os.Getenv("PICKUP_MIN_SPACING"), 64)
+	if err != nil || spacing < 0 {
+		return PICKUP_MIN_SPACING
+	}
+	return spacing
+}
+
+// Function to merge pickups from different rings that are closer than the minimum spacing.
+// Each group of near-identical points is merged into its best scoring point (inner rings win ties),
+// so each spot only costs one walk and one drive. Returns the kept points in ring order.
+func dedupePickupPoints(rings []ringPickups) []Location {
+	// Step 1. Flatten the rings
+	var points []Location
+	var scores []float64
+	for _, ring := range rings {
+		points = append(points, ring.Points...)
+		scores = append(scores, ring.Scores...)
+	}
+
+	// Step 2. Look at the best points first
+	order := make([]int, len(points))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	// Step 3. Keep each point unless a better one is already kept nearby
+	spacing := pickupMinSpacing()
+	keep := make([]bool, len(points))
+	var kept []Location
+	for _, i := range order {
+		duplicate := false
+		for _, other := range kept {
+			if distanceMiles(points[i], other) < spacing {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			keep[i] = true
+			kept = append(kept, points[i])
+		}
+	}
+
+	// Step 4. Put the kept points back in ring order
+	deduped := []Location{}
+	for i, point := range points {
+		if keep[i] {
+			deduped = append(deduped, point)
+		}
+	}
+
+	stageLog("dedupe").Debug("deduplicated pickup candidates", "candidates", len(points), "kept", len(deduped), "minSpacing", spacing)
+	return deduped
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestDedupePickupPoints(t *testing.T) {
+	center := Location{Latitude: 30.6, Longitude: -96.3}
+	near := Location{Latitude: center.Latitude + milesToDegLatitude(0.005, center.Latitude), Longitude: center.Longitude}
+	far := Location{Latitude: center.Latitude + milesToDegLatitude(0.2, center.Latitude), Longitude: center.Longitude}
+
+	// center and near are the same spot, near is on the better street
+	rings := []ringPickups{
+		{Ring: 0, Points: []Location{center, far}, Scores: []float64{0.4, 0.6}},
+		{Ring: 1, Points: []Location{near}, Scores: []float64{1}},
+	}
+	deduped := dedupePickupPoints(rings)
+	if len(deduped) != 2 || deduped[0] != far || deduped[1] != near {
+		t.Errorf("Fail: expected far and near, got %+v", deduped)
+	}
+
+	// Turning the spacing off keeps everything
+	t.Setenv("PICKUP_MIN_SPACING", "0")
+	if deduped := dedupePickupPoints(rings); len(deduped) != 3 {
+		t.Errorf("Fail: expected 3 points with no spacing, got %d", len(deduped))
+	}
+}
+
+func TestDedupePickupPointsAcrossAntimeridian(t *testing.T) {
+	// The same spot (~0.004mi apart) either side of 180
+	west := Location{Latitude: -17, Longitude: 179.99997}
+	east := Location{Latitude: -17, Longitude: -179.99997}
+	rings := []ringPickups{
+		{Ring: 0, Points: []Location{west}, Scores: []float64{0.4}},
+		{Ring: 1, Points: []Location{east}, Scores: []float64{1}},
+	}
+	if deduped := dedupePickupPoints(rings); len(deduped) != 1 || deduped[0] != east {
+		t.Errorf("Fail: expected the points to merge into the better one, got %+v", deduped)
+	}
+}
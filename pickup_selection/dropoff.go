@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Constant for the most drop-off points tried per request (every pickup is paired with every drop-off)
+const DROPOFF_MAX_POINTS int = 4
+
+// Function to place drop-off points on rings around the destination, closest first (capped at DROPOFF_MAX_POINTS).
+// Uses the same ring machinery as pickups, with the trip reversed so the rings are sized the same way.
+// Returns the drop-offs and the streets around the destination.
+func getDropoffPoints(source Location, destination Location, maxWalk float64, streetQuery StreetQuery) ([]Location, []Way, error) {
+	// Step 1. Get the streets around the destination
+	plan := planRings(destination, source, maxWalk)
+	streets, err := streetSource.GetStreets(plan.BoxSize, destination, streetQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Step 2. Place points on the rings (favoring the side the car comes from)
+	plan = planSegments(plan, streetDensity(streets, destination, plan.BoxSize))
+	dropoffs := StreamPickupPoints(destination, source, streets, plan)
+
+	// Step 3. Keep the shortest walks (rings come back in any order)
+	sort.SliceStable(dropoffs, func(i, j int) bool {
+		return distanceMiles(dropoffs[i], destination) < distanceMiles(dropoffs[j], destination)
+	})
+	if len(dropoffs) > DROPOFF_MAX_POINTS {
+		dropoffs = dropoffs[:DROPOFF_MAX_POINTS]
+	}
+
+	return dropoffs, streets, nil
+}
+
+// Walks from every source to one destination, summarized, and whether each could be walked
+type walkSummaries struct {
+	Summaries []RouteSummary
+	Walked    []bool
+	Err       error
+}
+
+// Helper function to walk every source to destination (see ORSMatrix)
+func walkSummariesTo(sources []Location, destination Location) walkSummaries {
+	routes, walked, err := ORSMatrix(routeCache, sources, []Location{destination}, "nil")
+	return walkSummaries{Summaries: SummarizeRoutes(routes), Walked: walked, Err: err}
+}
+
+// Helper function to pick each pickup's quickest drop-off door to door (drive plus walk from the drop-off),
+// from a matrix of drives from every pickup to every drop-off.
+// Drop-offs that couldn't be walked from (dropoffWalked) are skipped.
+// Returns the index of each pickup's drop-off, or -1 if none could be driven to.
+func quickestDropoffs(routes []Route, routed []bool, dropoffWalks []RouteSummary, dropoffWalked []bool, numberPickups int, numberDropoffs int) []int {
+	quickest := make([]int, numberPickups)
+	for i := range quickest {
+		quickest[i] = -1
+		bestTime := math.Inf(1)
+		for j := 0; j < numberDropoffs; j++ {
+			cell := i*numberDropoffs + j
+			if !routed[cell] || !dropoffWalked[j] {
+				continue
+			}
+			if doorToDoor := float64(routes[cell].TravelTimeInSeconds) + dropoffWalks[j].Time; doorToDoor < bestTime {
+				quickest[i], bestTime = j, doorToDoor
+			}
+		}
+	}
+	return quickest
+}
+
+// Function to build rides for each pickup via its quickest drop-off, and straight to the destination.
+// Every pickup -> drop-off pair is driven in one matrix request to find the quickest drop-off, then the drives
+// kept are routed with the batch API (with the car's heading), as the matrix has no historic times to price by.
+// The last pickup must be the source and the last drop-off the destination, so the last ride is the
+// no-walking ride (for savings calculations).
+// headings[i] is the car's heading at pickups[i] (or -1 if unknown)
+// Returns the rides, their pricing data, and the index of each ride's pickup.
+func StreamBuildDropoffRides(source Location, destination Location, pickups []Location, headings []float64, dropoffs []Location) ([]Ride, []MLPricingData, []int, error) {
+	// Make channels to receive both walks
+	pickupWalksChannel := make(chan walkSummaries)
+	dropoffWalksChannel := make(chan walkSummaries)
+
+	// Goroutine to retrieve the walks to each pickup
+	go func() {
+		pickupWalksChannel <- walkSummariesTo(pickups, source)
+	}()
+
+	// Goroutine to retrieve the walks from each drop-off
+	go func() {
+		dropoffWalksChannel <- walkSummariesTo(dropoffs, destination)
+	}()
+
+	// Step 1. Drive every pair at once to find each pickup's quickest drop-off
+	// (the source is only driven straight to the destination, and every pickup is driven there below)
+	routes, routed, err := getTomTomMatrix(routeCache, pickups[:len(pickups)-1], dropoffs[:len(dropoffs)-1])
+	pickupWalks := <-pickupWalksChannel
+	dropoffWalks := <-dropoffWalksChannel
+	for _, walkErr := range []error{err, pickupWalks.Err, dropoffWalks.Err} {
+		if walkErr != nil {
+			return nil, nil, nil, walkErr
+		}
+	}
+	quickest := quickestDropoffs(routes, routed, dropoffWalks.Summaries, dropoffWalks.Walked, len(pickups)-1, len(dropoffs)-1)
+
+	// Step 2. Route the kept drives with the batch API, one batch per drop-off
+	// candidates[j] are the pickups driven to dropoffs[j], and every pickup is driven to the destination
+	// (pickups that couldn't be walked to aren't driven at all)
+	candidates := make([][]int, len(dropoffs))
+	for i := range pickups {
+		if !pickupWalks.Walked[i] {
+			continue
+		}
+		if i < len(quickest) && quickest[i] >= 0 {
+			candidates[quickest[i]] = append(candidates[quickest[i]], i)
+		}
+		candidates[len(dropoffs)-1] = append(candidates[len(dropoffs)-1], i)
+	}
+	drives := make([]map[int]Route, len(dropoffs))
+	var wg sync.WaitGroup
+	for j, indices := range candidates {
+		drives[j] = make(map[int]Route)
+		if len(indices) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sources := make([]Location, len(indices))
+			sourceHeadings := make([]float64, len(indices))
+			for k, i := range indices {
+				sources[k] = pickups[i]
+				sourceHeadings[k] = headings[i]
+			}
+			batchRoutes, batchRouted := getTomTomRoutes(routeCache, sources, sourceHeadings, dropoffs[j])
+			for k, i := range indices {
+				if batchRouted[k] {
+					drives[j][i] = batchRoutes[k]
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := drives[len(dropoffs)-1][len(pickups)-1]; !ok {
+		return nil, nil, nil, fmt.Errorf("could not route the source to the destination")
+	}
+
+	// Step 3. Build a ride for every drive (pickup order, destination last, keeps the no-walking ride last)
+	var rides []Ride
+	var pricedDrives []Route
+	var pickupIndices []int
+	for i := range pickups {
+		for j := range dropoffs {
+			drive, ok := drives[j][i]
+			if !ok {
+				continue
+			}
+
+			// Rides to the destination itself have no drop-off walk
+			ride := BuildRide(pickupWalks.Summaries[i], SummarizeRoutes([]Route{drive})[0])
+			ride.Destination = destination
+			if j < len(dropoffs)-1 {
+				dropoffWalk := dropoffWalks.Summaries[j]
+				dropoffPoint := dropoffs[j]
+				ride.DropoffPoint = &dropoffPoint
+				ride.DropoffWalkTime = dropoffWalk.Time
+				ride.DropoffWalkDistance = dropoffWalk.Distance
+				ride.TotalTime += dropoffWalk.Time
+				ride.TotalDistance += dropoffWalk.Distance
+			}
+
+			rides = append(rides, ride)
+			pricedDrives = append(pricedDrives, drive)
+			pickupIndices = append(pickupIndices, i)
+		}
+	}
+
+	return rides, BuildPricingData(pricedDrives), pickupIndices, nil
+}
+
+// Function to pick the cheapest priced ride for each of the first numberPickups pickups.
+// Returns the rides and their pickup indices, in pickup order (pickups with no ride are skipped).
+func cheapestDropoffRides(rides []Ride, pickupIndices []int, numberPickups int) ([]Ride, []int) {
+	best := make([]int, numberPickups)
+	for i := range best {
+		best[i] = -1
+	}
+	for i, ride := range rides {
+		pickup := pickupIndices[i]
+		if pickup >= numberPickups {
+			continue
+		}
+		if best[pickup] < 0 || ride.Price < rides[best[pickup]].Price {
+			best[pickup] = i
+		}
+	}
+
+	var cheapest []Ride
+	var cheapestIndices []int
+	for pickup, ride := range best {
+		if ride < 0 {
+			continue
+		}
+		cheapest = append(cheapest, rides[ride])
+		cheapestIndices = append(cheapestIndices, pickup)
+	}
+	return cheapest, cheapestIndices
+}
+
+// Function to build and price rides that also walk from a drop-off point to the destination.
+// pickups must end with the source, and headings[i] is the car's heading at pickups[i] (or -1 if unknown).
+// Returns the cheapest ride per pickup (excluding the source) and the index of each ride's pickup.
+func optimizeDropoffs(source Location, destination Location, maxWalk float64, streetQuery StreetQuery, pickups []Location, headings []float64) ([]Ride, []int, error) {
+	// Step 1. Place drop-offs, ending with the destination itself
+	dropoffs, dropoffStreets, err := getDropoffPoints(source, destination, maxWalk, streetQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	dropoffs = append(dropoffs, destination)
+
+	// Step 2. Build and price each pickup's quickest drop-off and its ride to the destination
+	rides, pricingData, pickupIndices, err := StreamBuildDropoffRides(source, destination, pickups, headings, dropoffs)
+	if err != nil {
+		return nil, nil, err
+	}
+	rides, err = PriceRides(routeCache, rides, pricingData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Step 3. Name the drop-off streets
+	for i := range rides {
+		if rides[i].DropoffPoint != nil {
+			rides[i].DropoffStreet = reverseGeocode(*rides[i].DropoffPoint, dropoffStreets)
+		}
+	}
+
+	// Step 4. Keep the cheapest drop-off for each pickup
+	rides, pickupIndices = cheapestDropoffRides(rides, pickupIndices, len(pickups)-1)
+	return rides, pickupIndices, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCheapestDropoffRides(t *testing.T) {
+	// Pickup 0 has two drop-offs, pickup 1 none, pickup 2 is the source
+	rides := []Ride{{Price: 12}, {Price: 9}, {Price: 15}}
+	pickupIndices := []int{0, 0, 2}
+
+	cheapest, indices := cheapestDropoffRides(rides, pickupIndices, 2)
+	if len(cheapest) != 1 || cheapest[0].Price != 9 {
+		t.Fatalf("Fail: expected the 9 ride only, got %+v", cheapest)
+	}
+	if indices[0] != 0 {
+		t.Errorf("Fail: expected pickup 0, got %d", indices[0])
+	}
+}
+
+func TestQuickestDropoffs(t *testing.T) {
+	// Pickup 0 drives faster to drop-off 0, but walks further from it; pickup 1 can only reach drop-off 1
+	routes := []Route{{TravelTimeInSeconds: 300}, {TravelTimeInSeconds: 360}, {}, {TravelTimeInSeconds: 400}}
+	routed := []bool{true, true, false, true}
+	dropoffWalks := []RouteSummary{{Time: 200}, {Time: 60}}
+
+	quickest := quickestDropoffs(routes, routed, dropoffWalks, []bool{true, true}, 2, 2)
+	if quickest[0] != 1 || quickest[1] != 1 {
+		t.Errorf("Fail: expected drop-off 1 for both pickups, got %v", quickest)
+	}
+
+	// Drop-offs ORS couldn't walk from are never picked
+	quickest = quickestDropoffs(routes, routed, dropoffWalks, []bool{true, false}, 2, 2)
+	if quickest[0] != 0 || quickest[1] != -1 {
+		t.Errorf("Fail: expected drop-off 0 for the first pickup and none for the second, got %v", quickest)
+	}
+
+	// No drop-off could be driven to
+	quickest = quickestDropoffs(routes[:2], []bool{false, false}, dropoffWalks, []bool{true, true}, 1, 2)
+	if quickest[0] != -1 {
+		t.Errorf("Fail: expected no drop-off, got %v", quickest)
+	}
+}
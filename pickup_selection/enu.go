@@ -0,0 +1,68 @@
+package main
+
+import "math"
+
+// Local east-north-up (ENU) frame on the WGS84 ellipsoid (GIS_A, GIS_E), in mi.
+// Unlike scaling degrees at the center latitude, this has no trouble near the poles or across the
+// antimeridian, and over a pickup search area distances in it match straight lines through the earth
+// (ECEF chords, not geodesics along the surface) to within millimeters.
+
+// GIS helper function
+// Returns the earth-centered, earth-fixed (ECEF) coordinates of a location on the ellipsoid (in mi)
+func toECEF(location Location) (float64, float64, float64) {
+	phi := location.Latitude * (math.Pi / 180)
+	lambda := location.Longitude * (math.Pi / 180)
+
+	// N = radius of curvature in the prime vertical
+	N := GIS_A / math.Sqrt(1-math.Pow(GIS_E*math.Sin(phi), 2))
+
+	return N * math.Cos(phi) * math.Cos(lambda),
+		N * math.Cos(phi) * math.Sin(lambda),
+		N * (1 - GIS_E*GIS_E) * math.Sin(phi)
+}
+
+// GIS helper function
+// Returns the location on the ellipsoid under ECEF coordinates (in mi), using Bowring's formula
+func fromECEF(x float64, y float64, z float64) Location {
+	b := GIS_A * math.Sqrt(1-GIS_E*GIS_E)
+	ep2 := (GIS_A*GIS_A - b*b) / (b * b)
+	p := math.Hypot(x, y)
+
+	theta := math.Atan2(z*GIS_A, p*b)
+	phi := math.Atan2(z+ep2*b*math.Pow(math.Sin(theta), 3), p-GIS_E*GIS_E*GIS_A*math.Pow(math.Cos(theta), 3))
+
+	return Location{
+		Latitude:  phi * 180 / math.Pi,
+		Longitude: math.Atan2(y, x) * 180 / math.Pi,
+	}
+}
+
+// GIS helper function
+// Returns the (east, north) position of a point in the tangent plane at origin (in mi)
+func toLocalENU(origin Location, point Location) (float64, float64) {
+	phi := origin.Latitude * (math.Pi / 180)
+	lambda := origin.Longitude * (math.Pi / 180)
+
+	ox, oy, oz := toECEF(origin)
+	px, py, pz := toECEF(point)
+	dx, dy, dz := px-ox, py-oy, pz-oz
+
+	east := -math.Sin(lambda)*dx + math.Cos(lambda)*dy
+	north := -math.Sin(phi)*math.Cos(lambda)*dx - math.Sin(phi)*math.Sin(lambda)*dy + math.Cos(phi)*dz
+	return east, north
+}
+
+// GIS helper function
+// Returns the location under an (east, north) position in the tangent plane at origin (in mi)
+func fromLocalENU(origin Location, east float64, north float64) Location {
+	phi := origin.Latitude * (math.Pi / 180)
+	lambda := origin.Longitude * (math.Pi / 180)
+
+	// Rotate back into ECEF (the point sits on the tangent plane, fromECEF drops it onto the ellipsoid)
+	ox, oy, oz := toECEF(origin)
+	dx := -math.Sin(lambda)*east - math.Sin(phi)*math.Cos(lambda)*north
+	dy := math.Cos(lambda)*east - math.Sin(phi)*math.Sin(lambda)*north
+	dz := math.Cos(phi) * north
+
+	return fromECEF(ox+dx, oy+dy, oz+dz)
+}
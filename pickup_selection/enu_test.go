@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLocalENURoundTrip(t *testing.T) {
+	for _, origin := range []Location{
+		{Latitude: 30.6, Longitude: -96.3},
+		{Latitude: 89.99, Longitude: 45},
+		{Latitude: -65, Longitude: 179.999},
+	} {
+		point := fromLocalENU(origin, 0.6, -0.8)
+		east, north := toLocalENU(origin, point)
+		if math.Abs(east-0.6) > 1e-6 || math.Abs(north+0.8) > 1e-6 {
+			t.Errorf("Fail: round trip at %+v came back as (%f, %f)", origin, east, north)
+		}
+	}
+}
+
+func TestToLocalENU(t *testing.T) {
+	// 1 degree of longitude along the equator is 2*pi*a/360 (~69.17mi)
+	east, north := toLocalENU(Location{}, Location{Longitude: 1})
+	if math.Abs(east-2*math.Pi*GIS_A/360) > 0.01 || math.Abs(north) > 0.01 {
+		t.Errorf("Fail: expected ~69.17mi east, got (%f, %f)", east, north)
+	}
+
+	// Crossing the antimeridian is a short hop east, not most of the way around the world
+	east, _ = toLocalENU(Location{Longitude: 179.999}, Location{Longitude: -179.999})
+	if math.Abs(east-0.002*2*math.Pi*GIS_A/360) > 1e-4 {
+		t.Errorf("Fail: expected a short hop across the antimeridian, got %f", east)
+	}
+}
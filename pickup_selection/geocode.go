@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Constant for how close a pickup must be to an intersection to be described by its corner (in mi, ~160ft)
+const GEOCODE_CORNER_DISTANCE float64 = 0.03
+
+// Constant for how far to look for a cross-street along the pickup's street (in mi, ~800ft)
+const GEOCODE_CROSS_STREET_DISTANCE float64 = 0.15
+
+// Helper function to get the distance (in mi) from a location to the closest point on a way
+func distanceToWay(location Location, way Way) float64 {
+	return distanceMiles(location, locationAlongWay(way, projectOntoWay(location, way)))
+}
+
+// Helper function to name the corner of an intersection a location sits on (e.g. "NE")
+func cornerName(location Location, intersection Location) string {
+	corner := "S"
+	if location.Latitude >= intersection.Latitude {
+		corner = "N"
+	}
+	if location.Longitude >= intersection.Longitude {
+		return corner + "E"
+	}
+	return corner + "W"
+}
+
+// Describe a pickup point by street and cross-street using already fetched street ways
+// (e.g. "Texas Ave & University Dr, NE corner"), with no extra API calls.
+// Returns "" if no named street is nearby.
+func reverseGeocode(point Location, streets []Way) string {
+	// Step 1. Find the closest named street
+	street := -1
+	streetDistance := math.Inf(1)
+	for i, way := range streets {
+		if way.Name == "" || len(way.Geometry) < 2 {
+			continue
+		}
+		if distance := distanceToWay(point, way); distance < streetDistance {
+			street, streetDistance = i, distance
+		}
+	}
+	if street < 0 {
+		return ""
+	}
+	name := streets[street].Name
+
+	// Step 2. Collect the nodes of that street
+	onStreet := make(map[Location]bool)
+	for _, node := range streets[street].Geometry {
+		onStreet[node] = true
+	}
+
+	// Step 3. Find the closest node shared with a differently named street
+	crossName := ""
+	var crossNode Location
+	crossDistance := GEOCODE_CROSS_STREET_DISTANCE
+	for _, way := range streets {
+		if way.Name == "" || way.Name == name {
+			continue
+		}
+		for _, node := range way.Geometry {
+			if !onStreet[node] {
+				continue
+			}
+			if distance := distanceMiles(point, node); distance < crossDistance {
+				crossName, crossNode, crossDistance = way.Name, node, distance
+			}
+		}
+	}
+
+	// Step 4. Format
+	if crossName == "" {
+		return name
+	}
+	if crossDistance <= GEOCODE_CORNER_DISTANCE {
+		return fmt.Sprintf("%s & %s, %s corner", name, crossName, cornerName(point, crossNode))
+	}
+	return fmt.Sprintf("%s near %s", name, crossName)
+}
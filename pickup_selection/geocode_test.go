@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestReverseGeocode(t *testing.T) {
+	// Texas Ave runs north-south, University Dr runs east-west, meeting at corner
+	corner := Location{Latitude: 30.62, Longitude: -96.33}
+	north := Location{Latitude: 30.62 + milesToDegLatitude(0.2, 30.62), Longitude: -96.33}
+	east := Location{Latitude: 30.62, Longitude: -96.33 + milesToDegLongitude(0.2, 30.62)}
+	streets := []Way{
+		NewWay(1, []Location{corner, north}, map[string]string{"name": "Texas Ave"}),
+		NewWay(2, []Location{corner, east}, map[string]string{"name": "University Dr"}),
+	}
+
+	// Just north-east of the intersection, on Texas Ave
+	point := Location{Latitude: 30.62 + milesToDegLatitude(0.02, 30.62), Longitude: -96.33 + milesToDegLongitude(0.002, 30.62)}
+	response := reverseGeocode(point, streets)
+	expected := "Texas Ave & University Dr, NE corner"
+	if response != expected {
+		t.Errorf("Result was incorrect, got: %s, want: %s", response, expected)
+	}
+
+	// Mid-block on Texas Ave
+	point = Location{Latitude: 30.62 + milesToDegLatitude(0.1, 30.62), Longitude: -96.33}
+	response = reverseGeocode(point, streets)
+	expected = "Texas Ave near University Dr"
+	if response != expected {
+		t.Errorf("Result was incorrect, got: %s, want: %s", response, expected)
+	}
+
+	// No named streets
+	if response := reverseGeocode(point, nil); response != "" {
+		t.Errorf("Result was incorrect, got: %s, want empty", response)
+	}
+}
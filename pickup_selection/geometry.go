@@ -51,28 +51,32 @@ func intersectLineRing(cx float64, cy float64, a float64, b float64, x1 float64,
 }
 
 // Returns [][lat, long]
-func intersectWayRing(wayGeom []Location, radius float64, center Location) []Location {
+// Solves in the local ENU frame at the center, so points land at the radius (as a straight line through the earth)
+// anywhere on earth
+func intersectWayRing(way Way, radius float64, center Location) []Location {
 	// Step 0. Ignore empty geom
+	wayGeom := way.Geometry
 	if len(wayGeom) == 0 {
 		return []Location{}
 	}
 
-	// Step 1. Get the two radii of the ellipse
-	a := milesToDegLongitude(radius, center.Latitude)
-	b := milesToDegLatitude(radius, center.Latitude)
+	// Step 1. Put the way in the local frame (in mi)
+	easts := make([]float64, len(wayGeom))
+	norths := make([]float64, len(wayGeom))
+	for i, node := range wayGeom {
+		easts[i], norths[i] = toLocalENU(center, node)
+	}
 
 	// Step 2. Accumulate points
 	var points []Location
 	for i := range wayGeom[:len(wayGeom)-1] {
-		// Get line segment
-		x1 := wayGeom[i].Longitude
-		y1 := wayGeom[i].Latitude
-		x2 := wayGeom[i+1].Longitude
-		y2 := wayGeom[i+1].Latitude
-
-		// Get solutions and concat
-		solutions := intersectLineRing(center.Longitude, center.Latitude, a, b, x1, y1, x2, y2)
-		points = append(points, solutions...)
+		// Get solutions on the circle (these come back with Longitude = east, Latitude = north)
+		solutions := intersectLineRing(0, 0, radius, radius, easts[i], norths[i], easts[i+1], norths[i+1])
+
+		// Take them back to lat/long and concat
+		for _, solution := range solutions {
+			points = append(points, fromLocalENU(center, solution.Longitude, solution.Latitude))
+		}
 	}
 
 	return points
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
 
 func TestIntersectLineRing(t *testing.T) {
 	response := intersectLineRing(35.23, 53, 532, 34.532, 67.46, 65.74, 27.646, 73.43)
@@ -12,11 +16,11 @@ func TestIntersectLineRing(t *testing.T) {
 
 func TestIntersectWayRing(t *testing.T) {
 	response := intersectWayRing(
-		[]Location{
+		Way{Geometry: []Location{
 			{Latitude: 37.7749, Longitude: -122.4194},
 			{Latitude: 40.7128, Longitude: -74.0060},
 			{Latitude: 51.5074, Longitude: -0.1278},
-		},
+		}},
 		10.24,
 		Location{Latitude: 32.4525, Longitude: -124.423})
 
@@ -39,3 +43,56 @@ func TestCullByAngle(t *testing.T) {
 		t.Errorf("Result was incorrect, got: nil")
 	}
 }
+
+// Property test: wherever the ring is, the points found are on the ring and on the way (to within 1e-6mi, ~2mm).
+// Distances are straight lines through the earth (ECEF chords), not geodesics along its surface.
+func TestIntersectWayRingOnRadius(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	centers := []Location{
+		{Latitude: 30.6, Longitude: -96.3},
+		{Latitude: 89.99, Longitude: 10},  // near the north pole
+		{Latitude: -89.5, Longitude: -40}, // near the south pole
+		{Latitude: 64.8, Longitude: 179.999},
+		{Latitude: -16.5, Longitude: -179.995}, // across the antimeridian
+	}
+	for i := 0; i < 200; i++ {
+		centers = append(centers, Location{Latitude: random.Float64()*179.8 - 89.9, Longitude: random.Float64()*360 - 180})
+	}
+
+	for _, center := range centers {
+		radius := 0.05 + random.Float64()*1.5
+
+		// A street from inside the ring to outside it
+		inAngle, outAngle := random.Float64()*2*math.Pi, random.Float64()*2*math.Pi
+		inside := fromLocalENU(center, 0.8*radius*math.Sin(inAngle), 0.8*radius*math.Cos(inAngle))
+		outside := fromLocalENU(center, 1.5*radius*math.Sin(outAngle), 1.5*radius*math.Cos(outAngle))
+
+		solutions := intersectWayRing(Way{Geometry: []Location{inside, outside}}, radius, center)
+		if len(solutions) != 1 {
+			t.Errorf("Fail: expected 1 crossing at %+v, got %d", center, len(solutions))
+			continue
+		}
+
+		// Distance from the center as a straight line through the earth
+		cx, cy, cz := toECEF(center)
+		sx, sy, sz := toECEF(solutions[0])
+		if distance := math.Sqrt(math.Pow(sx-cx, 2) + math.Pow(sy-cy, 2) + math.Pow(sz-cz, 2)); math.Abs(distance-radius) > 1e-6 {
+			t.Errorf("Fail: crossing at %+v is %fmi from the center, expected %fmi", center, distance, radius)
+		}
+
+		// The crossing lies on the street
+		if distance := distanceToSegmentENU(center, solutions[0], inside, outside); distance > 1e-6 {
+			t.Errorf("Fail: crossing at %+v is %fmi off the street", center, distance)
+		}
+	}
+}
+
+// Helper function to get the distance (in mi) from a point to the segment a-b in the local frame at center
+func distanceToSegmentENU(center Location, point Location, a Location, b Location) float64 {
+	px, py := toLocalENU(center, point)
+	ax, ay := toLocalENU(center, a)
+	bx, by := toLocalENU(center, b)
+	t := math.Max(0, math.Min(1, ((px-ax)*(bx-ax)+(py-ay)*(by-ay))/((bx-ax)*(bx-ax)+(by-ay)*(by-ay))))
+	return math.Hypot(px-ax-t*(bx-ax), py-ay-t*(by-ay))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// Constant for walking speed (in mph, close to ORS foot-walking)
+const WALK_SPEED_MPH float64 = 3.1
+
+// Constant for the walking times (in minutes) of each isochrone contour
+var ISOCHRONE_MINUTES []float64 = []float64{2, 5, 8}
+
+// Constant for storing segments per isochrone in limiting queried points
+var ISOCHRONE_CULL_SEGMENTS []int = []int{4, 4, 3}
+
+// Constant for storing points per segment in limiting queried points
+var ISOCHRONE_CULL_AMOUNTS []int = []int{1, 1, 1}
+
+// Constant for the highway classes only walked on (footpaths and the like), fetched for the walking graph
+var WALKWAY_HIGHWAY_CLASSES []string = []string{"footway", "path", "pedestrian", "steps", "living_street", "cycleway"}
+
+// Constant for the tags that keep a walkway out of the walking graph
+var WALKWAY_EXCLUDED_TAGS []string = []string{"access=private", "access=no", "foot=no", "foot=private"}
+
+// One direction of a street segment in the walking graph
+type walkEdge struct {
+	To     int
+	Length float64 // in mi
+	Street int     // index of the way this edge is part of
+}
+
+// Walking graph built from street ways (walking ignores one-way restrictions)
+type WalkGraph struct {
+	Nodes []Location
+	Edges [][]walkEdge
+	index map[Location]int
+}
+
+// Function to get the street query for walkways (see WALKWAY_HIGHWAY_CLASSES)
+func walkwayQuery() StreetQuery {
+	return StreetQuery{
+		HighwayClasses: WALKWAY_HIGHWAY_CLASSES,
+		ExcludedTags:   WALKWAY_EXCLUDED_TAGS,
+	}
+}
+
+// Function to build a walking graph from street ways, joining ways at shared nodes
+func NewWalkGraph(streets []Way) *WalkGraph {
+	graph := &WalkGraph{index: make(map[Location]int)}
+
+	for streetID, street := range streets {
+		if len(street.Geometry) < 2 {
+			continue
+		}
+		for i := range street.Geometry[:len(street.Geometry)-1] {
+			from := graph.node(street.Geometry[i])
+			to := graph.node(street.Geometry[i+1])
+			length := distanceMiles(street.Geometry[i], street.Geometry[i+1])
+
+			graph.Edges[from] = append(graph.Edges[from], walkEdge{To: to, Length: length, Street: streetID})
+			graph.Edges[to] = append(graph.Edges[to], walkEdge{To: from, Length: length, Street: streetID})
+		}
+	}
+
+	return graph
+}
+
+// Helper function to get (or add) the graph node at a location
+func (graph *WalkGraph) node(location Location) int {
+	if id, ok := graph.index[location]; ok {
+		return id
+	}
+	id := len(graph.Nodes)
+	graph.index[location] = id
+	graph.Nodes = append(graph.Nodes, location)
+	graph.Edges = append(graph.Edges, nil)
+	return id
+}
+
+// Helper function to split the edges between from and to with a new node at location.
+// Returns the new node.
+func (graph *WalkGraph) splitEdge(from int, to int, location Location) int {
+	middle := graph.node(location)
+	for _, ends := range [][2]int{{from, to}, {to, from}} {
+		edges := graph.Edges[ends[0]]
+		for i, edge := range edges {
+			if edge.To != ends[1] {
+				continue
+			}
+			length := distanceMiles(graph.Nodes[ends[0]], location)
+			graph.Edges[ends[0]][i] = walkEdge{To: middle, Length: length, Street: edge.Street}
+			graph.Edges[middle] = append(graph.Edges[middle], walkEdge{To: ends[0], Length: length, Street: edge.Street})
+			break
+		}
+	}
+	return middle
+}
+
+// Priority queue of (node, distance) for Dijkstra
+type walkQueueItem struct {
+	Node     int
+	Distance float64
+}
+type walkQueue []walkQueueItem
+
+func (q walkQueue) Len() int            { return len(q) }
+func (q walkQueue) Less(i, j int) bool  { return q[i].Distance < q[j].Distance }
+func (q walkQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *walkQueue) Push(x interface{}) { *q = append(*q, x.(walkQueueItem)) }
+func (q *walkQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Find the walking distance (in mi) from source to every node with Dijkstra.
+// The walk starts by heading straight to the closest street segment, which gets a node where it meets it.
+// Unreachable nodes are +Inf.
+func (graph *WalkGraph) WalkingDistances(source Location) []float64 {
+	distances := make([]float64, len(graph.Nodes))
+	for i := range distances {
+		distances[i] = math.Inf(1)
+	}
+
+	// Step 1. Find the closest segment to the source
+	bestFrom, bestTo := -1, -1
+	bestDistance, bestT := math.Inf(1), 0.0
+	for from, edges := range graph.Edges {
+		for _, edge := range edges {
+			a := graph.Nodes[from]
+			b := graph.Nodes[edge.To]
+
+			// Project onto the segment in a local frame (in mi) centered on a
+			bx := (b.Longitude - a.Longitude) / milesToDegLongitude(1, a.Latitude)
+			by := (b.Latitude - a.Latitude) / milesToDegLatitude(1, a.Latitude)
+			px := (source.Longitude - a.Longitude) / milesToDegLongitude(1, a.Latitude)
+			py := (source.Latitude - a.Latitude) / milesToDegLatitude(1, a.Latitude)
+			t := 0.0
+			if bx != 0 || by != 0 {
+				t = math.Max(0, math.Min(1, (px*bx+py*by)/(bx*bx+by*by)))
+			}
+
+			if distance := math.Hypot(px-bx*t, py-by*t); distance < bestDistance {
+				bestFrom, bestTo, bestDistance, bestT = from, edge.To, distance, t
+			}
+		}
+	}
+	if bestFrom < 0 {
+		return distances
+	}
+
+	// Step 2. Start from where the source meets that segment, splitting it there
+	// (so contours along it are measured from the source, not from its ends)
+	start := bestFrom
+	if bestT >= 1 {
+		start = bestTo
+	} else if bestT > 0 {
+		start = graph.splitEdge(bestFrom, bestTo, interpolateLocation(graph.Nodes[bestFrom], graph.Nodes[bestTo], bestT))
+		distances = append(distances, math.Inf(1))
+	}
+	distances[start] = bestDistance
+	queue := &walkQueue{}
+	heap.Push(queue, walkQueueItem{Node: start, Distance: bestDistance})
+
+	// Step 3. Dijkstra
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(walkQueueItem)
+		if item.Distance > distances[item.Node] {
+			continue
+		}
+		for _, edge := range graph.Edges[item.Node] {
+			if distance := item.Distance + edge.Length; distance < distances[edge.To] {
+				distances[edge.To] = distance
+				heap.Push(queue, walkQueueItem{Node: edge.To, Distance: distance})
+			}
+		}
+	}
+
+	return distances
+}
+
+// Find the points on the streets exactly a walking distance (in mi) from the source.
+// Returns the points and, for each, the index of the street it lies on.
+func (graph *WalkGraph) IsochronePoints(distances []float64, limit float64) ([]Location, []int) {
+	var points []Location
+	var streets []int
+
+	// A contour crosses every edge walked into from below the limit but ending past it
+	for from, edges := range graph.Edges {
+		if distances[from] >= limit {
+			continue
+		}
+		for _, edge := range edges {
+			if edge.Length <= 0 || distances[from]+edge.Length <= limit || distances[edge.To]+edge.Length <= limit {
+				continue
+			}
+
+			// Skip crossings that are closer from the other end
+			t := (limit - distances[from]) / edge.Length
+			if distances[edge.To]+(1-t)*edge.Length < limit {
+				continue
+			}
+
+			points = append(points, interpolateLocation(graph.Nodes[from], graph.Nodes[edge.To], t))
+			streets = append(streets, edge.Street)
+		}
+	}
+
+	return points, streets
+}
+
+// Function to get the walking distance (in mi) of each isochrone contour, and how to cull it,
+// never walking further than the rider allows (maxWalk in mi, 0 if none).
+// Contours past maxWalk are merged into one at maxWalk.
+func isochroneLimits(maxWalk float64) ([]float64, []int, []int) {
+	var limits []float64
+	var segments, amounts []int
+	for contourID, minutes := range ISOCHRONE_MINUTES {
+		limit := WALK_SPEED_MPH * minutes / 60
+		if maxWalk > 0 && limit >= maxWalk {
+			limit = maxWalk
+		}
+		if len(limits) > 0 && limit <= limits[len(limits)-1] {
+			break
+		}
+		limits = append(limits, limit)
+		segments = append(segments, ISOCHRONE_CULL_SEGMENTS[contourID])
+		amounts = append(amounts, ISOCHRONE_CULL_AMOUNTS[contourID])
+	}
+	return limits, segments, amounts
+}
+
+// Function to place pickup points on walking isochrones (ISOCHRONE_MINUTES) through the street network
+// instead of straight-line rings, so a river or railway between the rider and a street counts.
+// walkways (see walkwayQuery) are walked on too, but pickups are only placed on streets.
+// No pickup is further than maxWalk (in mi, 0 if none) to walk.
+func StreamIsochronePickupPoints(center Location, destination Location, streets []Way, walkways []Way, maxWalk float64) []Location {
+	// Step 1. Walk the network once, then find where each contour crosses the streets
+	span := startSpan("intersection")
+	graph := NewWalkGraph(append(append([]Way{}, streets...), walkways...))
+	distances := graph.WalkingDistances(center)
+	limits, segments, amounts := isochroneLimits(maxWalk)
+	crossings := make([]ringCrossings, len(limits))
+	for contourID, limit := range limits {
+		points, pointStreets := graph.IsochronePoints(distances, limit)
+		for i, streetID := range pointStreets {
+			// Walkways come after the streets
+			if streetID < len(streets) {
+				crossings[contourID].Points = append(crossings[contourID].Points, points[i])
+				crossings[contourID].Streets = append(crossings[contourID].Streets, streetID)
+			}
+		}
+	}
+	span.End()
+
+	// Step 2. Snap and cull them into pickups
+	return cullRingCrossings(crossings, streets, center, destination, segments, amounts)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWalkingDistances(t *testing.T) {
+	// A U-shaped street: two parallel 0.4mi streets 0.05mi apart, joined only at their east ends
+	// (like two banks of a river with one bridge)
+	lat := 30.6
+	at := func(east float64, north float64) Location {
+		return Location{Latitude: lat + milesToDegLatitude(north, lat), Longitude: -96.3 + milesToDegLongitude(east, lat)}
+	}
+	streets := []Way{
+		NewWay(1, []Location{at(0, 0), at(0.4, 0)}, nil),
+		NewWay(2, []Location{at(0.4, 0), at(0.4, 0.05)}, nil),
+		NewWay(3, []Location{at(0, 0.05), at(0.4, 0.05)}, nil),
+	}
+
+	graph := NewWalkGraph(streets)
+	distances := graph.WalkingDistances(at(0, 0))
+
+	// The far bank's west end is 0.05mi away as the crow flies, but 0.85mi to walk
+	response := distances[graph.index[at(0, 0.05)]]
+	if math.Abs(response-0.85) > 0.001 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 0.85)
+	}
+
+	// A 0.2mi isochrone only crosses the near bank
+	points, pointStreets := graph.IsochronePoints(distances, 0.2)
+	if len(points) != 1 || pointStreets[0] != 0 {
+		t.Fatalf("Fail: expected one point on the first street, got %v %v", points, pointStreets)
+	}
+	if distance := distanceMiles(at(0, 0), points[0]); math.Abs(distance-0.2) > 0.001 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", distance, 0.2)
+	}
+}
+
+func TestStreamIsochronePickupPoints(t *testing.T) {
+	// Two parallel 0.8mi streets 0.05mi apart (a river between them), crossed only by a footbridge 0.05mi east
+	lat := 30.6
+	at := func(east float64, north float64) Location {
+		return Location{Latitude: lat + milesToDegLatitude(north, lat), Longitude: -96.3 + milesToDegLongitude(east, lat)}
+	}
+	streets := []Way{
+		NewWay(1, []Location{at(-0.4, 0), at(0.05, 0), at(0.4, 0)}, map[string]string{"highway": "residential"}),
+		NewWay(2, []Location{at(-0.4, 0.05), at(0.05, 0.05), at(0.4, 0.05)}, map[string]string{"highway": "residential"}),
+	}
+	walkways := []Way{
+		NewWay(3, []Location{at(0.05, 0), at(0.05, 0.05)}, map[string]string{"highway": "footway"}),
+	}
+	center := at(0, 0)
+	destination := at(0, 5)
+
+	// Helper function to check the pickups are exactly the expected (east, north) points, in any order
+	expectPoints := func(name string, points []Location, expected [][2]float64) {
+		t.Helper()
+		if len(points) != len(expected) {
+			t.Errorf("Fail: %s: expected %d points, got %d (%v)", name, len(expected), len(points), points)
+			return
+		}
+		for _, want := range expected {
+			found := false
+			for _, point := range points {
+				if distanceMiles(point, at(want[0], want[1])) < 0.001 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("Fail: %s: expected a point %.4fmi east, %.4fmi north, got %v", name, want[0], want[1], points)
+			}
+		}
+	}
+
+	// With a 0.15mi max walk, the 2 minute (0.1033mi) contour is kept and the rest merge into one at 0.15mi.
+	// The far bank is 0.1mi away over the footbridge, but pickups are never placed on the footbridge itself.
+	// The 2 minute contour crosses the far bank either side of the footbridge, level with each other, so the westernmost wins.
+	expectPoints("footbridge", StreamIsochronePickupPoints(center, destination, streets, walkways, 0.15), [][2]float64{
+		{-0.1033, 0}, {0.1033, 0}, {0.0467, 0.05},
+		{-0.15, 0}, {0.15, 0}, {0, 0.05}, {0.1, 0.05},
+	})
+
+	// Without it the far bank can't be reached
+	expectPoints("no footbridge", StreamIsochronePickupPoints(center, destination, streets, nil, 0.15), [][2]float64{
+		{-0.1033, 0}, {0.1033, 0},
+		{-0.15, 0}, {0.15, 0},
+	})
+}
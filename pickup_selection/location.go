@@ -37,6 +37,7 @@ func milesToDegLongitude(miles float64, latitude float64) float64 {
 // center - the center of the bounding box
 // Returns: the bounding box in the form of
 // .. (left, bottom, right, top)
+// .. (left and right run past ±180 near the antimeridian, see splitAtAntimeridian)
 func getUserBoundingBox(size float64, center Location) (float64, float64, float64, float64) {
 	// Convert miles to degrees latitude and longitude
 	degLat := milesToDegLatitude(size, center.Latitude)
@@ -50,3 +51,82 @@ func getUserBoundingBox(size float64, center Location) (float64, float64, float6
 
 	return left, bottom, right, top
 }
+
+// GIS helper function
+// Returns the longitude wrapped into [-180, 180)
+func wrapLongitude(longitude float64) float64 {
+	wrapped := math.Mod(longitude+180, 360)
+	if wrapped < 0 {
+		wrapped += 360
+	}
+	return wrapped - 180
+}
+
+// GIS helper function
+// Splits a (left, bottom, right, top) box from getUserBoundingBox at the antimeridian.
+// Returns: the box if it doesn't cross ±180, or the boxes on either side of it
+// (every longitude in [-180, 180])
+func splitAtAntimeridian(left float64, bottom float64, right float64, top float64) [][4]float64 {
+	switch {
+	case left < -180:
+		return [][4]float64{{left + 360, bottom, 180, top}, {-180, bottom, right, top}}
+	case right > 180:
+		return [][4]float64{{left, bottom, 180, top}, {-180, bottom, right - 360, top}}
+	default:
+		return [][4]float64{{left, bottom, right, top}}
+	}
+}
+
+// GIS helper function
+// Returns whether a location is inside a (left, bottom, right, top) box from getUserBoundingBox
+func boxContains(left float64, bottom float64, right float64, top float64, location Location) bool {
+	if location.Latitude < bottom || location.Latitude > top {
+		return false
+	}
+	// Measure east from the left edge, so a box running past ±180 still works
+	east := location.Longitude - left
+	east -= 360 * math.Floor(east/360)
+	return east <= right-left
+}
+
+// GIS helper function
+// Returns the distance in miles between two nearby locations
+// (in the tangent plane halfway between them, see toLocalENU, so it holds near the poles and across the antimeridian)
+func distanceMiles(a Location, b Location) float64 {
+	east, north := localDelta(a, b)
+	return math.Hypot(east, north)
+}
+
+// GIS helper function
+// Returns how far (east, north) b is from a in miles, in the tangent plane halfway between them
+// (so the answer is the same both ways round)
+func localDelta(a Location, b Location) (float64, float64) {
+	middle := interpolateLocation(a, b, 0.5)
+	aEast, aNorth := toLocalENU(middle, a)
+	bEast, bNorth := toLocalENU(middle, b)
+	return bEast - aEast, bNorth - aNorth
+}
+
+// GIS helper function
+// Returns the location a fraction t of the way from a to b
+// (taking the short way across the antimeridian)
+func interpolateLocation(a Location, b Location, t float64) Location {
+	return Location{
+		Latitude:  a.Latitude + (b.Latitude-a.Latitude)*t,
+		Longitude: wrapLongitude(a.Longitude + wrapLongitude(b.Longitude-a.Longitude)*t),
+	}
+}
+
+// GIS helper function
+// Returns the compass bearing in degrees (0 = north, 90 = east) from a to b
+// (in the tangent plane halfway between them, see localDelta)
+func bearingDegrees(a Location, b Location) float64 {
+	east, north := localDelta(a, b)
+
+	// Round off the rotation's floating point noise (so due east is exactly 90), then wrap to [0, 360)
+	bearing := math.Round(math.Atan2(east, north)*180/math.Pi*1e9) / 1e9
+	if bearing < 0 {
+		bearing += 360
+	}
+	return bearing
+}
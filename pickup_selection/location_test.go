@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"strconv"
 	"testing"
 )
@@ -40,3 +41,38 @@ func TestGetUserBoundingBox(t *testing.T) {
 		t.Errorf("Result was incorrect, got: %s, want: %s", responseArray, expectedArray)
 	}
 }
+
+func TestSplitAtAntimeridian(t *testing.T) {
+	// Away from 180 the box is kept whole
+	if boxes := splitAtAntimeridian(-96.4, 30.5, -96.2, 30.7); len(boxes) != 1 || boxes[0] != [4]float64{-96.4, 30.5, -96.2, 30.7} {
+		t.Errorf("Fail: expected the box whole, got %v", boxes)
+	}
+
+	// Across it, the box is split either side
+	left, bottom, right, top := getUserBoundingBox(2, Location{Latitude: -17, Longitude: 179.99})
+	boxes := splitAtAntimeridian(left, bottom, right, top)
+	if len(boxes) != 2 || boxes[0][0] != left || boxes[0][2] != 180 || boxes[1][0] != -180 || boxes[1][2] != right-360 {
+		t.Errorf("Fail: expected the box split at 180, got %v", boxes)
+	}
+
+	// And both halves are inside it
+	if !boxContains(left, bottom, right, top, Location{Latitude: -17, Longitude: -179.995}) || boxContains(left, bottom, right, top, Location{Latitude: -17, Longitude: 179.9}) {
+		t.Errorf("Fail: unexpected locations in the box across the antimeridian")
+	}
+}
+
+func TestDistanceAndBearingAcrossAntimeridian(t *testing.T) {
+	west := Location{Latitude: -17, Longitude: 179.995}
+	east := Location{Latitude: -17, Longitude: -179.995}
+
+	// ~0.66mi east, not most of the way around the world
+	if distance := distanceMiles(west, east); distance < 0.6 || distance > 0.7 {
+		t.Errorf("Fail: expected ~0.66mi, got %f", distance)
+	}
+	if bearing := bearingDegrees(west, east); math.Abs(bearing-90) > 0.01 {
+		t.Errorf("Fail: expected due east, got %f", bearing)
+	}
+	if middle := interpolateLocation(west, east, 0.5); math.Abs(math.Abs(middle.Longitude)-180) > 1e-9 {
+		t.Errorf("Fail: expected the middle on the antimeridian, got %+v", middle)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Constant for how many decimals of a coordinate are logged (2 is about 1km, enough to tell areas apart but not riders)
+const LOG_COORDINATE_DECIMALS int = 2
+
+// Patterns for API keys and credentials (user:password@) in URLs, and for coordinates in request and response bodies
+var apiKeyPattern = regexp.MustCompile(`(?i)(\bkey=)[^&\s"]+`)
+var userinfoPattern = regexp.MustCompile(`(?i)(\b[a-z][a-z0-9+.-]*://)[^/?#@\s"]+@`)
+var coordinatePattern = regexp.MustCompile(`(-?\d{1,3}\.\d{2})\d+`)
+
+// Environment variables holding secrets that must never be logged
+var secretVariables = []string{"TOMTOM_API_KEY", "ORS_API_KEY", "MEMCACHED_PASSWORD", "REDIS_URL"}
+
+// Loggers for the container and for the request it's handling.
+// Lambda hands a container one request at a time, so one request logger is enough.
+var logState struct {
+	mutex   sync.RWMutex
+	base    *slog.Logger
+	request *slog.Logger
+}
+
+func init() {
+	setLogOutput(os.Stdout)
+}
+
+// Helper function to get the level to log at from LOG_LEVEL (debug, info, warn or error), info by default.
+// Request and response bodies are only logged at debug.
+func logLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Helper function to check if precise coordinates may be logged (LOG_PRECISE_LOCATIONS=true, for local debugging)
+func preciseLocations() bool {
+	return os.Getenv("LOG_PRECISE_LOCATIONS") == "true"
+}
+
+// Function to send logs (as JSON lines) to w, at the level from LOG_LEVEL
+func setLogOutput(w io.Writer) {
+	logger := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel(), ReplaceAttr: redactAttr}))
+
+	logState.mutex.Lock()
+	defer logState.mutex.Unlock()
+	logState.base = logger
+	logState.request = logger
+}
+
+// Function to tag every log line until the next request with the Lambda request ID
+func startRequestLog(ctx context.Context) {
+	logState.mutex.Lock()
+	defer logState.mutex.Unlock()
+
+	logState.request = logState.base
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		logState.request = logState.base.With("requestId", lc.AwsRequestID)
+	}
+}
+
+// Function to get the logger for one stage of the request (e.g. "tomtom", "pricing", "cache")
+func stageLog(stage string) *slog.Logger {
+	logState.mutex.RLock()
+	defer logState.mutex.RUnlock()
+	return logState.request.With("stage", stage)
+}
+
+// Helper function to strip secrets (and, unless allowed, precise coordinates) from a logged string
+func redactString(value string) string {
+	value = apiKeyPattern.ReplaceAllString(value, "${1}REDACTED")
+	value = userinfoPattern.ReplaceAllString(value, "${1}REDACTED@")
+	for _, name := range secretVariables {
+		if secret := os.Getenv(name); secret != "" {
+			value = strings.ReplaceAll(value, secret, "REDACTED")
+		}
+	}
+	if !preciseLocations() {
+		value = coordinatePattern.ReplaceAllString(value, "$1")
+	}
+	return value
+}
+
+// Helper function to redact every string (and error) logged
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(redactString(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			attr.Value = slog.StringValue(redactString(err.Error()))
+		}
+	}
+	return attr
+}
+
+// Function to log a Location, rounded to LOG_COORDINATE_DECIMALS unless LOG_PRECISE_LOCATIONS is set
+func (location Location) LogValue() slog.Value {
+	latitude, longitude := location.Latitude, location.Longitude
+	if !preciseLocations() {
+		scale := math.Pow(10, float64(LOG_COORDINATE_DECIMALS))
+		latitude = math.Round(latitude*scale) / scale
+		longitude = math.Round(longitude*scale) / scale
+	}
+	return slog.GroupValue(slog.Float64("lat", latitude), slog.Float64("long", longitude))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constant for the default number of entries kept in the in-process cache
+const LRU_DEFAULT_SIZE int = 10000
+
+// Helper function to get the in-process cache size from CACHE_LRU_SIZE, or the default
+func lruSize() int {
+	size, err := strconv.Atoi(os.Getenv("CACHE_LRU_SIZE"))
+	if err != nil || size <= 0 {
+		return LRU_DEFAULT_SIZE
+	}
+	return size
+}
+
+// One entry in the in-process cache
+type lruEntry struct {
+	key     string
+	value   string
+	expires time.Time // zero if it never expires
+}
+
+// Helper function to check whether an entry has expired
+func (entry *lruEntry) expired() bool {
+	return !entry.expires.IsZero() && time.Now().After(entry.expires)
+}
+
+// In-process least-recently-used cache, for running without memcached or Redis (locally and in tests).
+// Only lives as long as the Lambda container, so isn't shared between containers.
+type LRUCache struct {
+	size    int
+	mutex   sync.Mutex
+	order   *list.List // most recently used at the front
+	entries map[string]*list.Element
+}
+
+// Function to get a new LRUCache holding up to size entries
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Function to get a value from the cache (false if not found or expired)
+func (cache *LRUCache) Get(key string) (string, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.get(key)
+}
+
+// Helper function to get a value from the cache, with the mutex held
+func (cache *LRUCache) get(key string) (string, bool) {
+	element, ok := cache.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	// Drop expired entries as we find them
+	entry := element.Value.(*lruEntry)
+	if entry.expired() {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return "", false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Function to store a value in the cache, evicting the least recently used entry if full
+func (cache *LRUCache) Set(key string, value string, ttl int32) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.set(key, value, ttl)
+}
+
+// Helper function to store a value in the cache, with the mutex held
+// (a ttl of 0 or less never expires, like memcached and Redis)
+func (cache *LRUCache) set(key string, value string, ttl int32) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	// Update in place if already cached
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	// Make room
+	if cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+}
+
+// Function to store a value in the cache only if the key isn't there already (or has expired)
+// Checks and stores under one hold of the mutex, so only one of several concurrent adds wins.
+func (cache *LRUCache) Add(key string, value string, ttl int32) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, ok := cache.get(key); ok {
+		return false
+	}
+	cache.set(key, value, ttl)
+	return true
+}
+
+// Function to add to a counter in the cache (only a new counter gets the ttl, like memcached and Redis)
+func (cache *LRUCache) Incr(key string, delta int64, ttl int32) int64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// Add in place if the counter is live, keeping its expiry
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		if !entry.expired() {
+			value, _ := strconv.ParseInt(entry.value, 10, 64)
+			value += delta
+			entry.value = strconv.FormatInt(value, 10)
+			cache.order.MoveToFront(element)
+			return value
+		}
+	}
+
+	// Otherwise start from 0
+	cache.set(key, strconv.FormatInt(delta, 10), ttl)
+	return delta
+}
+
+// Function to get many values from the cache
+func (cache *LRUCache) GetMulti(keys []string) map[string]string {
+	values := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := cache.Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// Function to store many values in the cache
+func (cache *LRUCache) SetMulti(values map[string]string, ttl int32) {
+	for key, value := range values {
+		cache.Set(key, value, ttl)
+	}
+}
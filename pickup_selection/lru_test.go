@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("a", "1", 60)
+	cache.Set("b", "2", 60)
+
+	// Using a makes b the least recently used
+	if value, ok := cache.Get("a"); !ok || value != "1" {
+		t.Fatalf("Fail: expected a=1, got %q %v", value, ok)
+	}
+	cache.Set("c", "3", 60)
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Fail: expected b to be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Fail: expected a to be kept")
+	}
+
+	// No ttl never expires
+	cache.Set("d", "4", 0)
+	if value, ok := cache.Get("d"); !ok || value != "4" {
+		t.Errorf("Fail: expected d to be kept with no ttl, got %q %v", value, ok)
+	}
+
+	// Expired entries are misses
+	cache.entries["d"].Value.(*lruEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := cache.Get("d"); ok {
+		t.Errorf("Fail: expected d to have expired")
+	}
+
+	// Adding only stores missing (or expired) keys
+	if cache.Add("a", "5", 60) {
+		t.Errorf("Fail: expected adding a to find it")
+	}
+	if !cache.Add("d", "6", 60) {
+		t.Errorf("Fail: expected adding the expired d to store it")
+	}
+	if value, _ := cache.Get("a"); value != "1" {
+		t.Errorf("Fail: expected a=1 to be kept, got %q", value)
+	}
+}
+
+func TestLRUCacheAddConcurrent(t *testing.T) {
+	cache := NewLRUCache(10)
+
+	// Only one of many racing adds stores the key
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	added := 0
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cache.Add("claim", "1", 60) {
+				mutex.Lock()
+				added++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Errorf("Fail: expected exactly one add to win, got %d", added)
+	}
+}
+
+func TestLRUCacheIncr(t *testing.T) {
+	cache := NewLRUCache(2)
+	if value := cache.Incr("count", 5, 60); value != 5 {
+		t.Errorf("Fail: expected a missing counter to start from 0, got %d", value)
+	}
+	if value := cache.Incr("count", 2, 60); value != 7 {
+		t.Errorf("Fail: expected 7, got %d", value)
+	}
+	if value, _ := cache.Get("count"); value != "7" {
+		t.Errorf("Fail: expected the counter stored as text, got %q", value)
+	}
+
+	// Adding keeps the expiry the counter was created with
+	cache.Incr("count", 1, -1)
+	if value, ok := cache.Get("count"); !ok || value != "8" {
+		t.Errorf("Fail: expected adding to keep the counter's expiry, got %q %v", value, ok)
+	}
+}
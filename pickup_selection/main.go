@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"os"
 	"sort"
-	"time"
+	"strconv"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/lambda"
 )
@@ -15,17 +17,29 @@ type PickupSelectionRequest = struct {
 	Source      Location `json:"source"`
 	Destination Location `json:"destination"`
 	MaxPoints   int      `json:"maxPoints"`
+	// Optional override of which streets pickups may be placed on
+	Streets *StreetQuery `json:"streets,omitempty"`
+	// Optional override of how pickups are placed ("rings" or "isochrone")
+	Generator string `json:"generator,omitempty"`
+	// Optional furthest the rider is willing to walk (in mi)
+	MaxWalk float64 `json:"maxWalk,omitempty"`
+	// Optionally also try dropping the rider off near the destination
+	OptimizeDropoff bool `json:"optimizeDropoff,omitempty"`
+	// Optionally only report today's routing API usage (no rides)
+	Stats bool `json:"stats,omitempty"`
 }
 
 // AWS Lambda output
 type PickupSelectionResponse struct {
 	Rides []Ride `json:"rides"`
+	// Today's routing API usage (only for stats requests)
+	Usage []ProviderUsage `json:"usage,omitempty"`
 }
 
-// Constant for storing radii of rings for pickup selection
+// Constant for storing the default radii of rings for pickup selection (see planRings)
 var RING_RADII []float64 = []float64{0.1, 0.25, 0.5, 0.75}
 
-// Constant for storing segments per ring in limiting queried points
+// Constant for storing the default segments per ring in limiting queried points (see planSegments)
 var CULL_SEGMENTS []int = []int{4, 4, 3, 3}
 
 // Constant for storing points per segment in limiting queried points
@@ -57,100 +71,169 @@ func SummarizeRoutes(routes []Route) []RouteSummary {
 	return summaries
 }
 
-// Multithreaded function to do intersections between rings and streets
-func StreamPickupPoints(center Location, streetGeometries [][]Location) []Location {
-	pointsChannel := make(chan []Location)
+// Helper function to turn one ring's street crossings into pickup points.
+// Snaps each to a legal curbside spot, then keeps the best per segment (see cullTowardDestination).
+// solutionStreets[i] is the index into streets of the way solutions[i] lies on.
+// Returns the kept points and how good a street each is on.
+func snapAndCullRing(solutions []Location, solutionStreets []int, streets []Way, intersections map[Location]bool, center Location, destination Location, numberSegments int, pointsPerSegment int) ([]Location, []float64) {
+	// Store the points for this ring, and how good a street each is on
+	var points []Location
+	var scores []float64
+
+	// Snap them to a legal curbside spot and append them to the points slice
+	for i, solution := range solutions {
+		street := streets[solutionStreets[i]]
+		if point, ok := snapToCurbside(solution, street, intersections); ok {
+			points = append(points, point)
+			scores = append(scores, scoreWay(street))
+		}
+	}
 
-	// Loop through 4 preset radii to find the intersecting points
-	for ringID, radius := range RING_RADII {
-		go func() {
-			// Store the points for this ring
-			var points []Location
-
-			// For this specific radius, find the intersecting points
-			// and append them to the points slice
-			for _, streetGeom := range streetGeometries {
-				solutions := intersectWayRing(streetGeom, radius, center)
-				points = append(points, solutions...)
-			}
+	// Now cull the points
+	return cullTowardDestination(points, scores, center, destination, numberSegments, pointsPerSegment)
+}
+
+// One ring's (or contour's) street crossings, and the index into streets of the way each lies on
+type ringCrossings struct {
+	Points  []Location
+	Streets []int
+}
+
+// Multithreaded function to turn every ring's street crossings into pickup points (see snapAndCullRing).
+// segments[i] and amounts[i] are how to cull ring i. Timed as the "culling" span.
+// Returns the pickups, keeping one of each spot neighbouring rings both landed on.
+func cullRingCrossings(crossings []ringCrossings, streets []Way, center Location, destination Location, segments []int, amounts []int) []Location {
+	span := startSpan("culling")
+	defer span.End()
+	pointsChannel := make(chan ringPickups)
+
+	// Find the intersections once so every ring can keep pickups out of them
+	intersections := findIntersectionNodes(streets)
 
-			// Now cull the points
-			pointsChannel <- cullByAngle(points, center, CULL_SEGMENTS[ringID], CULL_AMOUNTS[ringID])
+	// Snap and cull each ring
+	for ringID, ring := range crossings {
+		go func() {
+			points, scores := snapAndCullRing(ring.Points, ring.Streets, streets, intersections, center, destination, segments[ringID], amounts[ringID])
+			pointsChannel <- ringPickups{Ring: ringID, Points: points, Scores: scores}
 		}()
 	}
 
-	// Receive from channels
-	var culledPoints []Location
-	for range RING_RADII {
-		culledPoints = append(culledPoints, <-pointsChannel...)
+	// Receive from channels (back in ring order)
+	rings := make([]ringPickups, len(crossings))
+	for range crossings {
+		ring := <-pointsChannel
+		rings[ring.Ring] = ring
+	}
+
+	// Neighbouring rings can land on the same spot, so only keep one of each
+	points := dedupePickupPoints(rings)
+	span.SetAttr("points", strconv.Itoa(len(points)))
+	return points
+}
+
+// Multithreaded function to do intersections between rings and streets
+// Pickups are culled to favor heading toward destination.
+func StreamPickupPoints(center Location, destination Location, streets []Way, plan RingPlan) []Location {
+	// Step 1. Find where each planned ring crosses the streets
+	span := startSpan("intersection")
+	crossings := make([]ringCrossings, len(plan.Radii))
+	var wg sync.WaitGroup
+	for ringID, radius := range plan.Radii {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for streetID, street := range streets {
+				for _, solution := range intersectWayRing(street, radius, center) {
+					crossings[ringID].Points = append(crossings[ringID].Points, solution)
+					crossings[ringID].Streets = append(crossings[ringID].Streets, streetID)
+				}
+			}
+		}()
 	}
-	// Return response
-	return culledPoints
+	wg.Wait()
+	span.End()
+
+	// Step 2. Snap and cull them into pickups
+	return cullRingCrossings(crossings, streets, center, destination, plan.Segments, plan.Amounts)
 }
 
 // Multithreaded function for building rides given source -> pickup -> destination
-func StreamBuildRides(source Location, destination Location, pickups []Location) ([]Ride, []MLPricingData) {
-	// Make a channel to receive inboundSummaries
+// headings[i] is the car's heading at pickups[i] (or -1 if unknown)
+// Pickups ORS couldn't walk to, or TomTom couldn't route to the destination, get no ride.
+// Returns the rides, their pricing data, and the index of each ride's pickup.
+func StreamBuildRides(source Location, destination Location, pickups []Location, headings []float64) ([]Ride, []MLPricingData, []int, error) {
+	// Make a channel to receive inboundSummaries, whether each could be walked, and any ORS error
 	inboundSummariesChannel := make(chan []RouteSummary)
+	inboundWalkedChannel := make(chan []bool)
+	inboundErrChannel := make(chan error)
 
-	// Make a channel to receive outboundSummaries
-	outboundSummariesChannel := make(chan []RouteSummary)
-
-	// Make a channel to receive pricingData
-	pricingDataChannel := make(chan []MLPricingData)
+	// Make a channel to receive outboundRoutes, and whether each could be routed
+	outboundRoutesChannel := make(chan []Route)
+	outboundRoutedChannel := make(chan []bool)
 
 	// Goroutine to retrieve inbound summaries
-	go func(c chan []RouteSummary) {
+	go func(c chan []RouteSummary, w chan []bool, e chan error) {
 		// Go get inbound summaries
 		urlTest := "nil"
-		inboundRoutes := ORSMatrix(pickups, []Location{source}, urlTest)
+		inboundRoutes, walked, err := ORSMatrix(routeCache, pickups, []Location{source}, urlTest)
 		inboundSummaries := SummarizeRoutes(inboundRoutes)
 		c <- inboundSummaries
-	}(inboundSummariesChannel)
-
-	// Goroutine to retrieve outbound summaries
-	go func(c chan []RouteSummary, m chan []MLPricingData) {
-		// Go get inbound summaries
-		outboundRoutes := getTomTomRoutes(
+		w <- walked
+		e <- err
+	}(inboundSummariesChannel, inboundWalkedChannel, inboundErrChannel)
+
+	// Goroutine to retrieve outbound routes
+	go func(c chan []Route, r chan []bool) {
+		outboundRoutes, routed := getTomTomRoutes(
+			routeCache,
 			pickups,
+			headings,
 			destination,
 		)
+		c <- outboundRoutes
+		r <- routed
+	}(outboundRoutesChannel, outboundRoutedChannel)
 
-		// Now summarize routes
-		outboundSummaries := SummarizeRoutes(outboundRoutes)
-		c <- outboundSummaries
-
-		// Get the day-of-week and time-of-day
-		// TODO: in future we would want the user's time zone...
-		// assume CDT for now
-		loc := time.FixedZone("CDT", -5*60*60)
-		now := time.Now().In(loc)
-		day_of_week := float64(now.Weekday()) / 7
-		time_of_day := (float64(now.Hour()) + (float64(now.Minute()) / 60)) / 24
-
-		// Now build pricing data
-		pricingData := make([]MLPricingData, len(outboundRoutes))
-		for i, route := range outboundRoutes {
-			data := MLPricingData{
-				TimeInSeconds:        float64(route.TravelTimeInSeconds),
-				DistanceInMeters:     float64(route.LengthInMeters),
-				TimeToHistoricRatio:  float64(route.TravelTimeInSeconds) / float64(route.HistoricalTrafficTravelTimeInSeconds),
-				TimeToNoTrafficRatio: float64(route.TravelTimeInSeconds) / float64(route.NoTrafficTravelTimeInSeconds),
-				DayOfWeekSin:         math.Sin(2 * math.Pi * day_of_week),
-				DayOfWeekCos:         math.Cos(2 * math.Pi * day_of_week),
-				TimeOfDaySin:         math.Sin(2 * math.Pi * time_of_day),
-				TimeOfDayCos:         math.Cos(2 * math.Pi * time_of_day),
-			}
-
-			pricingData[i] = data
+	// Now keep the walked and routed pickups
+	inboundSummaries := <-inboundSummariesChannel
+	walked := <-inboundWalkedChannel
+	err := <-inboundErrChannel
+	outboundRoutes := <-outboundRoutesChannel
+	routed := <-outboundRoutedChannel
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var keptInbound []RouteSummary
+	var keptOutbound []Route
+	var rideIndices []int
+	for i := range pickups {
+		if !walked[i] || !routed[i] {
+			continue
 		}
-		m <- pricingData
-	}(outboundSummariesChannel, pricingDataChannel)
+		keptInbound = append(keptInbound, inboundSummaries[i])
+		keptOutbound = append(keptOutbound, outboundRoutes[i])
+		rideIndices = append(rideIndices, i)
+	}
 
-	// Now build rides
-	inboundSummaries := <-inboundSummariesChannel
-	outboundSummaries := <-outboundSummariesChannel
-	return BuildRides(inboundSummaries, outboundSummaries), <-pricingDataChannel
+	// Now build rides and pricing data
+	return BuildRides(keptInbound, SummarizeRoutes(keptOutbound)), BuildPricingData(keptOutbound), rideIndices, nil
+}
+
+// Helper function to keep the pickups marked in keep (along with their orientations and labels),
+// up to maxPoints of them in ring order (all of them if maxPoints <= 0)
+func keepPickups(pickups []Location, orientations []PickupOrientation, labels []PickupLabel, keep []bool, maxPoints int) ([]Location, []PickupOrientation, []PickupLabel) {
+	var keptPickups []Location
+	var keptOrientations []PickupOrientation
+	var keptLabels []PickupLabel
+	for i := range pickups {
+		if !keep[i] || (maxPoints > 0 && len(keptPickups) >= maxPoints) {
+			continue
+		}
+		keptPickups = append(keptPickups, pickups[i])
+		keptOrientations = append(keptOrientations, orientations[i])
+		keptLabels = append(keptLabels, labels[i])
+	}
+	return keptPickups, keptOrientations, keptLabels
 }
 
 // AWS Lambda entrypoint
@@ -159,21 +242,186 @@ func HandleRequest(ctx context.Context, event *PickupSelectionRequest) (*PickupS
 		return nil, fmt.Errorf("received nil event")
 	}
 
-	// Get the street geometry in a 1mi x 1mi box centered at user position
-	streetGeometries := getStreetGeometry(1, event.Source, "nil")
-	culledPoints := StreamPickupPoints(event.Source, streetGeometries)
+	// Tag this request's logs and trace with its ID
+	startRequestLog(ctx)
+	startRequestTrace(ctx)
+	stageLog("request").Info("pickup selection request", "source", event.Source, "destination", event.Destination, "maxWalk", event.MaxWalk)
+
+	// Let cache writes finish and export telemetry before Lambda freezes the container
+	defer FlushTelemetry()
+	defer FlushCacheWrites()
+
+	// Look up how much of the routing quotas is used today (which is all stats requests want)
+	usage := startRequestBudget(routeCache)
+	if event.Stats {
+		return &PickupSelectionResponse{Rides: []Ride{}, Usage: usage}, nil
+	}
+
+	// Pick which pickup generator to use (before starting any upstream fetch)
+	generator := event.Generator
+	if generator == "" {
+		generator = os.Getenv("PICKUP_GENERATOR")
+	}
+	switch generator {
+	case "", "rings", "isochrone":
+	default:
+		return nil, fmt.Errorf("unknown pickup generator %q", generator)
+	}
+
+	// Size the rings (and the area to search) from the trip length and max walk
+	// The isochrone generator walks the network, so needs at least a 1mi box
+	plan := planRings(event.Source, event.Destination, event.MaxWalk)
+	if generator == "isochrone" {
+		plan.BoxSize = math.Max(plan.BoxSize, 1)
+	}
+
+	// Get the nearby named places in the background
+	// (these only label pickups, so carry on without them if Overpass is down;
+	// buffered, so the fetch never blocks if the request returns early)
+	poisChannel := make(chan []PointOfInterest, 1)
+	go func() {
+		pois, err := poiSource.GetPointsOfInterest(plan.BoxSize, event.Source)
+		if err != nil {
+			stageLog("poi").Warn("error getting points of interest", "error", err)
+		}
+		poisChannel <- pois
+	}()
+
+	// Get the footpaths in the same box in the background, for the isochrone generator to walk on
+	// (without them it can only walk along streets, so carry on if they can't be fetched)
+	walkwaysChannel := make(chan []Way, 1)
+	if generator == "isochrone" {
+		go func() {
+			walkways, err := streetSource.GetStreets(plan.BoxSize, event.Source, walkwayQuery())
+			if err != nil {
+				stageLog("geometry").Warn("error getting walkways", "error", err)
+			}
+			walkwaysChannel <- walkways
+		}()
+	}
+
+	// Get the street geometry in a box around the outer ring centered at user position
+	streetQuery := resolveStreetQuery(event.Streets)
+	span := startSpan("geometry")
+	streets, err := streetSource.GetStreets(plan.BoxSize, event.Source, streetQuery)
+	span.SetAttr("streets", strconv.Itoa(len(streets)))
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	// Share the points between rings by how many streets each should cross
+	plan = planSegments(plan, streetDensity(streets, event.Source, plan.BoxSize))
+
+	// Place pickups on straight-line rings, or on walking isochrones through the street network
+	// (intersecting them with the streets and culling toward the destination)
+	var culledPoints []Location
+	if generator == "isochrone" {
+		culledPoints = StreamIsochronePickupPoints(event.Source, event.Destination, streets, <-walkwaysChannel, event.MaxWalk)
+	} else {
+		culledPoints = StreamPickupPoints(event.Source, event.Destination, streets, plan)
+	}
+
+	// Work out which way the car faces at each pickup (dropping those facing away from the destination)
+	span = startSpan("orientation")
+	culledPoints, orientations := orientPickupPoints(culledPoints, event.Source, event.Destination, streets)
+	span.End()
+
+	// Label pickups by nearby meeting points, places and addresses
+	labels := labelPickupPoints(culledPoints, <-poisChannel)
+
+	// Past a hard quota budget, only keep pickups whose routes are already cached
+	keep := make([]bool, len(culledPoints))
+	for i := range keep {
+		keep[i] = true
+	}
+	if anyBudgetAt("hard") {
+		cachedHeadings := make([]float64, 0, len(orientations)+1)
+		for _, orientation := range orientations {
+			cachedHeadings = append(cachedHeadings, orientation.Heading)
+		}
+		cached := cachedOnlyPickups(routeCache, event.Source, event.Destination, append(append([]Location{}, culledPoints...), event.Source), append(cachedHeadings, -1))
+		if !cached[len(culledPoints)] {
+			return nil, fmt.Errorf("routing quota reached and no cached ride from here")
+		}
+		copy(keep, cached)
+	}
+
+	// Route at most MaxPoints pickups (fewer past a soft quota budget)
+	maxPoints := event.MaxPoints
+	if anyBudgetAt("soft") && (maxPoints <= 0 || maxPoints > softMaxPoints()) {
+		maxPoints = softMaxPoints()
+	}
+	culledPoints, orientations, labels = keepPickups(culledPoints, orientations, labels, keep, maxPoints)
 
 	// Add the source to the end of culled points for savings calculations
 	// This gets us the pricing data of the no-walking ride for free
+	// (the car's heading at the source is unknown)
+	var headings []float64
+	for _, orientation := range orientations {
+		headings = append(headings, orientation.Heading)
+	}
 	culledPoints = append(culledPoints, event.Source)
+	headings = append(headings, -1)
+
+	// Build and price rides, either to the destination or via the cheapest drop-off point
+	// (drop-offs need a matrix and batch of new drives, so are skipped past TomTom's hard budget)
+	// rideIndices[i] is the index of rides[i]'s pickup
+	var rides []Ride
+	var rideIndices []int
+	if event.OptimizeDropoff && budgetMode("tomtom") != "hard" {
+		span = startSpan("dropoffs")
+		rides, rideIndices, err = optimizeDropoffs(event.Source, event.Destination, event.MaxWalk, streetQuery, culledPoints, headings)
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Build rides in parallel (walk matrix and drive batch)
+		var pricingData []MLPricingData
+		span = startSpan("rides")
+		rides, pricingData, rideIndices, err = StreamBuildRides(event.Source, event.Destination, culledPoints, headings)
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+
+		// Savings need the no-walking ride
+		if len(rideIndices) == 0 || rideIndices[len(rideIndices)-1] != len(culledPoints)-1 {
+			return nil, fmt.Errorf("no route from the source to the destination")
+		}
 
-	// Build rides in parallel
-	rides, pricingData := StreamBuildRides(event.Source, event.Destination, culledPoints)
-	// Price rides
-	rides = PriceRides(rides, pricingData)
+		// Price rides
+		span = startSpan("pricing")
+		rides, err = PriceRides(routeCache, rides, pricingData)
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+
+		// Remember to take the no-walking ride out of the slice
+		rides = rides[:len(rides)-1]
+		rideIndices = rideIndices[:len(rideIndices)-1]
+	}
 
-	// Remember to take the no-walking ride out of the slice
-	rides = rides[:len(rides)-1]
+	// Attach the pickup labels (rides are still in pickup order here)
+	for i := range rides {
+		pickup := rideIndices[i]
+		rides[i].PickupName = labels[pickup].Name
+		rides[i].PickupAddress = labels[pickup].Address
+		rides[i].PickupStreet = reverseGeocode(rides[i].PickupPoint, streets)
+		rides[i].PickupHeading = orientations[pickup].Heading
+		rides[i].PickupSide = orientations[pickup].Side
+	}
 
 	// TODO: do something with ride prices, etc
 	// sort rides by price lowest -> highest
@@ -190,5 +438,27 @@ func HandleRequest(ctx context.Context, event *PickupSelectionRequest) (*PickupS
 }
 
 func main() {
+	// Connect to the cache once at cold start
+	cache, err := NewRouteCache()
+	if err != nil {
+		stageLog("startup").Error("error connecting to cache", "error", err)
+		os.Exit(1)
+	}
+	routeCache = cache
+
+	// Load the local OSM extract once at cold start, if there is one (for streets and POIs)
+	// Otherwise cache Overpass streets by map tile if there is a shared cache
+	if path := os.Getenv("OSM_PBF_PATH"); path != "" {
+		extract, err := LoadStreetExtract(path)
+		if err != nil {
+			stageLog("startup").Error("error loading street extract", "path", path, "error", err)
+			os.Exit(1)
+		}
+		streetSource = extract
+		poiSource = extract
+	} else if cacheBackend() != "memory" {
+		streetSource = TiledStreetSource{APIURL: "nil", Cache: routeCache}
+	}
+
 	lambda.Start(HandleRequest)
 }
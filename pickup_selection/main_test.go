@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 )
 
@@ -34,22 +36,89 @@ func TestStreamPickupPoints(t *testing.T) {
 	rows := 3
 	cols := 3
 
-	// Create a 2D array of Location structs with the specified dimensions
-	test_locations := make([][]Location, rows)
+	// Create an array of Way structs with the specified dimensions
+	test_locations := make([]Way, rows)
 	for i := range test_locations {
-		test_locations[i] = make([]Location, cols)
+		test_locations[i] = Way{Geometry: make([]Location, cols)}
 	}
 
 	// Populate the array with some Location values
 	for i := 0; i < rows; i++ {
 		for j := 0; j < cols; j++ {
 			// Assigning sample latitude and longitude values for demonstration
-			test_locations[i][j] = Location{Latitude: float64(i + 30), Longitude: float64(j + 90)}
+			test_locations[i].Geometry[j] = Location{Latitude: float64(i + 30), Longitude: float64(j + 90)}
 		}
 	}
-	result := StreamPickupPoints(test_center, test_locations)
+	result := StreamPickupPoints(test_center, test_center, test_locations, defaultRingPlan())
 	if result == nil {
 		t.Errorf("Fail: Got unexpected result, nil")
 	}
 
 }
+
+func TestKeepPickups(t *testing.T) {
+	pickups := []Location{{Latitude: 1}, {Latitude: 2}, {Latitude: 3}, {Latitude: 4}}
+	orientations := []PickupOrientation{{Heading: 10}, {Heading: 20}, {Heading: 30}, {Heading: 40}}
+	labels := []PickupLabel{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+
+	// Skip the second, then stop at 2
+	kept, keptOrientations, keptLabels := keepPickups(pickups, orientations, labels, []bool{true, false, true, true}, 2)
+	if len(kept) != 2 || kept[1].Latitude != 3 || keptOrientations[1].Heading != 30 || keptLabels[1].Name != "c" {
+		t.Errorf("Fail: expected the 1st and 3rd pickups, got %+v %+v %+v", kept, keptOrientations, keptLabels)
+	}
+
+	// No limit
+	if kept, _, _ := keepPickups(pickups, orientations, labels, []bool{true, true, true, true}, 0); len(kept) != 4 {
+		t.Errorf("Fail: expected every pickup with no limit, got %d", len(kept))
+	}
+}
+
+func TestHandleRequestStats(t *testing.T) {
+	t.Setenv("TOMTOM_DAILY_QUOTA", "")
+	t.Setenv("ORS_DAILY_QUOTA", "")
+	previous := routeCache
+	routeCache = NewLRUCache(10)
+	defer func() { routeCache = previous }()
+
+	recordBillable(routeCache, "tomtom", 12)
+	FlushCacheWrites()
+
+	response, err := HandleRequest(context.Background(), &PickupSelectionRequest{Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Rides) != 0 || len(response.Usage) != 2 || response.Usage[0].Used != 12 || response.Usage[0].Quota != TOMTOM_DEFAULT_DAILY_QUOTA {
+		t.Errorf("Fail: expected only usage with 12 TomTom items, got %+v", response)
+	}
+}
+
+// Street and POI source that only counts how often it's asked
+type countingSource struct {
+	calls atomic.Int32
+}
+
+func (source *countingSource) GetStreets(radius float64, center Location, streetQuery StreetQuery) ([]Way, error) {
+	source.calls.Add(1)
+	return nil, nil
+}
+
+func (source *countingSource) GetPointsOfInterest(radius float64, center Location) ([]PointOfInterest, error) {
+	source.calls.Add(1)
+	return nil, nil
+}
+
+func TestHandleRequestUnknownGenerator(t *testing.T) {
+	source := &countingSource{}
+	previousStreets, previousPOIs := streetSource, poiSource
+	streetSource, poiSource = source, source
+	defer func() { streetSource, poiSource = previousStreets, previousPOIs }()
+
+	// An unknown generator is turned away before anything is fetched
+	_, err := HandleRequest(context.Background(), &PickupSelectionRequest{Generator: "bogus"})
+	if err == nil {
+		t.Fatalf("Fail: expected an error for an unknown generator")
+	}
+	if calls := source.calls.Load(); calls != 0 {
+		t.Errorf("Fail: expected no upstream fetch, got %d", calls)
+	}
+}
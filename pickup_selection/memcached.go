@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mc client only gets or sets one key per round trip (and its hasher isn't safe to share between
+// goroutines), so batches speak the memcached binary protocol directly: quiet gets (GETKQ) or sets (SETQ)
+// for every key, pipelined on one connection per server and ended by a NOOP.
+// Misses and successful sets send nothing back, so everything before the NOOP's reply is a hit (or an error).
+
+// Constant for how long to wait on memcached before giving up (a cache miss is cheaper than a slow cache)
+const MEMCACHED_TIMEOUT time.Duration = 2 * time.Second
+
+// Binary protocol magic bytes, opcodes and statuses (see memcached's protocol_binary.h)
+const (
+	memcachedRequest              byte   = 0x80
+	memcachedResponse             byte   = 0x81
+	memcachedOpNoop               byte   = 0x0a
+	memcachedOpGetKQ              byte   = 0x0d
+	memcachedOpSetQ               byte   = 0x11
+	memcachedOpAuthStart          byte   = 0x21
+	memcachedStatusUnknownCommand uint16 = 0x81
+)
+
+// Constant for the length of a binary protocol header
+const memcachedHeaderLength int = 24
+
+// One binary protocol response
+type memcachedReply struct {
+	op     byte
+	status uint16
+	key    string
+	value  string
+}
+
+// One connection to one memcached server, opened (and logged in) lazily
+type memcachedConn struct {
+	address  string
+	username string
+	password string
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Memcached batches (multi-gets and multi-sets), with one connection per server
+type MemcachedBatcher struct {
+	servers []*memcachedConn
+}
+
+// Function to get a new MemcachedBatcher for a server list like the mc client takes
+// (separated by commas, semicolons or spaces), logging in with SASL PLAIN if a username or password is set
+func NewMemcachedBatcher(servers string, username string, password string) *MemcachedBatcher {
+	batcher := &MemcachedBatcher{}
+	for _, address := range strings.FieldsFunc(servers, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		batcher.servers = append(batcher.servers, &memcachedConn{address: address, username: username, password: password})
+	}
+	return batcher
+}
+
+// Helper function to pick a key's server the same way the mc client does (FNV-1a modulo the server count)
+func (batcher *MemcachedBatcher) serverFor(key string) int {
+	hash := fnv.New32a()
+	io.WriteString(hash, key)
+	return int(hash.Sum32() % uint32(len(batcher.servers)))
+}
+
+// Helper function to group keys by server and run each group on its server's connection, side by side.
+// Returns the first error.
+func (batcher *MemcachedBatcher) eachServer(keys []string, run func(conn *memcachedConn, keys []string) error) error {
+	if len(batcher.servers) == 0 {
+		return fmt.Errorf("memcached: no servers")
+	}
+
+	// Step 1. Group the keys by server
+	groups := make([][]string, len(batcher.servers))
+	for _, key := range keys {
+		server := batcher.serverFor(key)
+		groups[server] = append(groups[server], key)
+	}
+
+	// Step 2. Run each group on its server
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for server, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(batcher.servers[server], group); err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// Function to get many values in one round trip per server (missing keys are left out).
+// Servers are asked side by side. Returns the values found, and an error if any server failed.
+func (batcher *MemcachedBatcher) GetMulti(keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	var mutex sync.Mutex
+	err := batcher.eachServer(keys, func(conn *memcachedConn, keys []string) error {
+		found, err := conn.getMulti(keys)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for key, value := range found {
+			values[key] = value
+		}
+		return err
+	})
+
+	return values, err
+}
+
+// Function to store many values for ttl seconds in one round trip per server.
+// Servers are written side by side. Returns an error if any server failed (or refused a value).
+func (batcher *MemcachedBatcher) SetMulti(values map[string]string, ttl int32) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return batcher.eachServer(keys, func(conn *memcachedConn, keys []string) error {
+		return conn.setMulti(keys, values, ttl)
+	})
+}
+
+// Helper function to connect (and log in) if not connected already
+func (conn *memcachedConn) connect() error {
+	if conn.conn != nil {
+		return nil
+	}
+
+	c, err := net.DialTimeout("tcp", conn.address, MEMCACHED_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	conn.conn = c
+	conn.reader = bufio.NewReader(c)
+
+	// Log in (servers without SASL don't know the command, which is fine)
+	if conn.username == "" && conn.password == "" {
+		return nil
+	}
+	conn.conn.SetDeadline(time.Now().Add(MEMCACHED_TIMEOUT))
+	if _, err := conn.conn.Write(encodeMemcachedRequest(memcachedOpAuthStart, nil, "PLAIN", "\x00"+conn.username+"\x00"+conn.password)); err != nil {
+		conn.close()
+		return err
+	}
+	reply, err := readMemcachedReply(conn.reader)
+	if err != nil {
+		conn.close()
+		return err
+	}
+	if reply.status != 0 && reply.status != memcachedStatusUnknownCommand {
+		conn.close()
+		return fmt.Errorf("memcached: authentication failed (status %#x)", reply.status)
+	}
+	return nil
+}
+
+// Helper function to drop the connection (so the next multi-get reconnects)
+func (conn *memcachedConn) close() {
+	if conn.conn != nil {
+		conn.conn.Close()
+	}
+	conn.conn = nil
+	conn.reader = nil
+}
+
+// Helper function to get many keys from this server with quiet gets and a NOOP, in one round trip
+func (conn *memcachedConn) getMulti(keys []string) (map[string]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if err := conn.connect(); err != nil {
+		return nil, err
+	}
+
+	// Write every get, then the NOOP that marks the end
+	var pipeline []byte
+	for _, key := range keys {
+		pipeline = append(pipeline, encodeMemcachedRequest(memcachedOpGetKQ, nil, key, "")...)
+	}
+	pipeline = append(pipeline, encodeMemcachedRequest(memcachedOpNoop, nil, "", "")...)
+	conn.conn.SetDeadline(time.Now().Add(MEMCACHED_TIMEOUT))
+	if _, err := conn.conn.Write(pipeline); err != nil {
+		conn.close()
+		return nil, err
+	}
+
+	// Read hits until the NOOP comes back
+	values := make(map[string]string)
+	for {
+		reply, err := readMemcachedReply(conn.reader)
+		if err != nil {
+			conn.close()
+			return values, err
+		}
+		if reply.op == memcachedOpNoop {
+			return values, nil
+		}
+		if reply.status == 0 {
+			values[reply.key] = reply.value
+		}
+	}
+}
+
+// Helper function to set many keys (to their values) on this server with quiet sets and a NOOP, in one round trip
+func (conn *memcachedConn) setMulti(keys []string, values map[string]string, ttl int32) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if err := conn.connect(); err != nil {
+		return err
+	}
+
+	// Write every set (no flags, expiring in ttl seconds), then the NOOP that marks the end
+	var pipeline []byte
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[4:8], uint32(ttl))
+	for _, key := range keys {
+		pipeline = append(pipeline, encodeMemcachedRequest(memcachedOpSetQ, extras, key, values[key])...)
+	}
+	pipeline = append(pipeline, encodeMemcachedRequest(memcachedOpNoop, nil, "", "")...)
+	conn.conn.SetDeadline(time.Now().Add(MEMCACHED_TIMEOUT))
+	if _, err := conn.conn.Write(pipeline); err != nil {
+		conn.close()
+		return err
+	}
+
+	// Read failures until the NOOP comes back
+	var firstErr error
+	for {
+		reply, err := readMemcachedReply(conn.reader)
+		if err != nil {
+			conn.close()
+			return err
+		}
+		if reply.op == memcachedOpNoop {
+			return firstErr
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("memcached: set failed (status %#x: %s)", reply.status, reply.value)
+		}
+	}
+}
+
+// Helper function to encode a binary protocol request
+func encodeMemcachedRequest(op byte, extras []byte, key string, value string) []byte {
+	request := make([]byte, memcachedHeaderLength, memcachedHeaderLength+len(extras)+len(key)+len(value))
+	request[0] = memcachedRequest
+	request[1] = op
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+	request[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(request[8:12], uint32(len(extras)+len(key)+len(value)))
+	request = append(request, extras...)
+	request = append(request, key...)
+	return append(request, value...)
+}
+
+// Helper function to read one binary protocol response
+func readMemcachedReply(reader *bufio.Reader) (memcachedReply, error) {
+	header := make([]byte, memcachedHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return memcachedReply{}, err
+	}
+	if header[0] != memcachedResponse {
+		return memcachedReply{}, fmt.Errorf("memcached: malformed response (magic %#x)", header[0])
+	}
+	keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLength := int(header[4])
+	bodyLength := int(binary.BigEndian.Uint32(header[8:12]))
+	if extrasLength+keyLength > bodyLength {
+		return memcachedReply{}, fmt.Errorf("memcached: malformed response (body of %d bytes)", bodyLength)
+	}
+
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return memcachedReply{}, err
+	}
+	return memcachedReply{
+		op:     header[1],
+		status: binary.BigEndian.Uint16(header[6:8]),
+		key:    string(body[extrasLength : extrasLength+keyLength]),
+		value:  string(body[extrasLength+keyLength:]),
+	}, nil
+}
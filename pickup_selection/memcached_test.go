@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Helper function to run a tiny memcached stand-in speaking the binary protocol (GET, SET, GETKQ, SETQ, NOOP
+// and SASL PLAIN), holding data. Returns its address and how many connections it has accepted.
+func fakeMemcached(tb testing.TB, username string, password string, data map[string]string) (string, *int64) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	var mutex sync.Mutex
+	var accepted int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				writer := bufio.NewWriter(conn)
+				authed := username == "" && password == ""
+				for {
+					// Read one request
+					header := make([]byte, memcachedHeaderLength)
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+					op := header[1]
+					keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+					extrasLength := int(header[4])
+					body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+					if _, err := io.ReadFull(reader, body); err != nil {
+						return
+					}
+					key := string(body[extrasLength : extrasLength+keyLength])
+					value := string(body[extrasLength+keyLength:])
+
+					// Answer it (quiet misses get no answer)
+					reply := func(status uint16, extras []byte, key string, value string) {
+						response := make([]byte, memcachedHeaderLength)
+						response[0] = memcachedResponse
+						response[1] = op
+						binary.BigEndian.PutUint16(response[2:4], uint16(len(key)))
+						response[4] = byte(len(extras))
+						binary.BigEndian.PutUint16(response[6:8], status)
+						binary.BigEndian.PutUint32(response[8:12], uint32(len(extras)+len(key)+len(value)))
+						copy(response[12:16], header[12:16])
+						writer.Write(response)
+						writer.Write(extras)
+						writer.WriteString(key)
+						writer.WriteString(value)
+					}
+					flags := make([]byte, 4)
+					mutex.Lock()
+					stored, found := data[key]
+					switch {
+					case op == 0x20:
+						reply(0, nil, "", "PLAIN")
+					case op == memcachedOpAuthStart && value == "\x00"+username+"\x00"+password:
+						authed = true
+						reply(0, nil, "", "Authenticated")
+					case op == memcachedOpAuthStart:
+						reply(0x20, nil, "", "Auth failure")
+					case !authed:
+						reply(0x20, nil, "", "Auth required")
+					case op == 0x00 && found:
+						reply(0, flags, "", stored)
+					case op == 0x00:
+						reply(0x01, nil, "", "Not found")
+					case op == 0x01:
+						data[key] = value
+						reply(0, nil, "", "")
+					case op == memcachedOpSetQ:
+						data[key] = value
+					case op == memcachedOpGetKQ && found:
+						reply(0, flags, key, stored)
+					case op == memcachedOpGetKQ:
+					case op == memcachedOpNoop:
+						reply(0, nil, "", "")
+					default:
+						reply(memcachedStatusUnknownCommand, nil, "", "Unknown command")
+					}
+					mutex.Unlock()
+
+					// Send answers once the client has nothing more queued up
+					if reader.Buffered() == 0 {
+						writer.Flush()
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), &accepted
+}
+
+func TestMemcachedBatcher(t *testing.T) {
+	address, accepted := fakeMemcached(t, "user", "secret", map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	// Hits come back, misses are left out, all over one connection
+	batcher := NewMemcachedBatcher(address, "user", "secret")
+	values, err := batcher.GetMulti([]string{"a", "missing", "b", "c"})
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(values) != 3 || values["a"] != "1" || values["b"] != "2" || values["c"] != "3" {
+		t.Errorf("Fail: unexpected values %v", values)
+	}
+	if _, err := batcher.GetMulti([]string{"a"}); err != nil || atomic.LoadInt64(accepted) != 1 {
+		t.Errorf("Fail: expected the connection to be reused, got %d connections (%v)", atomic.LoadInt64(accepted), err)
+	}
+
+	// A bad login is an error, not a miss
+	if _, err := NewMemcachedBatcher(address, "user", "wrong").GetMulti([]string{"a"}); err == nil {
+		t.Errorf("Fail: expected an error logging in with the wrong password")
+	}
+}
+
+func TestMemcachedBatcherServers(t *testing.T) {
+	// Keys go to the server the mc client would pick
+	first, _ := fakeMemcached(t, "", "", map[string]string{})
+	second, _ := fakeMemcached(t, "", "", map[string]string{})
+	t.Setenv("CACHE_URL", first+","+second)
+	cache := NewPromCache()
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, key := range keys {
+		cache.Set(key, "value-"+key, 60)
+	}
+	values := cache.GetMulti(keys)
+	for _, key := range keys {
+		if values[key] != "value-"+key {
+			t.Errorf("Fail: expected %s from its server, got %v", key, values)
+		}
+	}
+}
+
+func TestPromCacheSetMultiConcurrent(t *testing.T) {
+	// Many batches stored at once (run with -race) each land on the server the mc client reads them from
+	first, _ := fakeMemcached(t, "", "", map[string]string{})
+	second, _ := fakeMemcached(t, "", "", map[string]string{})
+	t.Setenv("CACHE_URL", first+","+second)
+	cache := NewPromCache()
+
+	var wg sync.WaitGroup
+	for batch := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values := make(map[string]string)
+			for i := range 10 {
+				values[fmt.Sprintf("key-%d-%d", batch, i)] = fmt.Sprintf("value-%d-%d", batch, i)
+			}
+			cache.SetMulti(values, 60)
+		}()
+	}
+	wg.Wait()
+
+	for batch := range 8 {
+		for i := range 10 {
+			key := fmt.Sprintf("key-%d-%d", batch, i)
+			if value, ok := cache.Get(key); !ok || value != fmt.Sprintf("value-%d-%d", batch, i) {
+				t.Errorf("Fail: expected %s from its server, got %q %v", key, value, ok)
+			}
+		}
+	}
+}
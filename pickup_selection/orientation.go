@@ -0,0 +1,133 @@
+package main
+
+import "math"
+
+// Constant for the widest angle (in degrees) between the car's heading and the destination
+// before a pickup is considered to face away from it
+const ORIENTATION_MAX_ANGLE float64 = 120
+
+// Whether cars drive on the right (curb on the passenger's right) - true for the US
+var DRIVE_ON_RIGHT bool = true
+
+// The direction a car faces when picking up, and which side of the street the rider waits on
+type PickupOrientation struct {
+	Heading float64 // compass bearing in degrees (0 = north, 90 = east)
+	Side    string  // "left" or "right" of the car's direction of travel
+}
+
+// Helper function to get the smallest angle (in degrees) between two bearings
+func angleBetween(a float64, b float64) float64 {
+	difference := math.Mod(math.Abs(a-b), 360)
+	if difference > 180 {
+		difference = 360 - difference
+	}
+	return difference
+}
+
+// Helper function to get the bearing of a way (in the order of its nodes) at a position (in mi) along it
+func wayBearingAt(way Way, position float64) float64 {
+	traveled := 0.0
+	for i := range way.Geometry[:len(way.Geometry)-1] {
+		length := distanceMiles(way.Geometry[i], way.Geometry[i+1])
+		if length > 0 && traveled+length >= position {
+			return bearingDegrees(way.Geometry[i], way.Geometry[i+1])
+		}
+		traveled += length
+	}
+	return bearingDegrees(way.Geometry[len(way.Geometry)-2], way.Geometry[len(way.Geometry)-1])
+}
+
+// Helper function to work out which side of a car (heading at pickup) the rider (at source) is on
+func sideOfStreet(pickup Location, heading float64, source Location) string {
+	// Positive = the source is clockwise from the heading = on the right
+	relative := bearingDegrees(pickup, source) - heading
+	if math.Sin(relative*math.Pi/180) >= 0 {
+		return "right"
+	}
+	return "left"
+}
+
+// Helper function to get the side of a way ("left" or "right", in the order of its nodes) whose curb a car
+// pulls up to, driving along the way (forward) or against it
+func curbSideOfWay(forward bool) string {
+	if forward == DRIVE_ON_RIGHT {
+		return "right"
+	}
+	return "left"
+}
+
+// Work out which way the car faces at each pickup and which side of the street the rider waits on.
+// On two-way streets the car pulls up on the rider's side unless that faces away from the destination
+// (or stopping is forbidden on that curb), in which case the rider crosses. One-way streets fix the heading.
+// Pickups where the car would face away from the destination, or only pull up to a no-stopping curb, are dropped.
+// Returns the kept pickups and their orientations.
+func orientPickupPoints(pickups []Location, source Location, destination Location, streets []Way) ([]Location, []PickupOrientation) {
+	// The side of the car the curb is on
+	curbSide := "right"
+	if !DRIVE_ON_RIGHT {
+		curbSide = "left"
+	}
+
+	kept := []Location{}
+	orientations := []PickupOrientation{}
+	for _, pickup := range pickups {
+		// Step 1. Find the street this pickup is on
+		street := -1
+		streetDistance := math.Inf(1)
+		for i, way := range streets {
+			if len(way.Geometry) < 2 {
+				continue
+			}
+			if distance := distanceToWay(pickup, way); distance < streetDistance {
+				street, streetDistance = i, distance
+			}
+		}
+
+		// Keep pickups we can't place on a street, with no heading hint
+		if street < 0 {
+			kept = append(kept, pickup)
+			orientations = append(orientations, PickupOrientation{Heading: -1})
+			continue
+		}
+
+		// Step 2. Get the possible headings along the street
+		way := streets[street]
+		forward := wayBearingAt(way, projectOntoWay(pickup, way))
+		backward := math.Mod(forward+180, 360)
+
+		var headings []float64
+		switch way.Oneway {
+		case 1:
+			headings = []float64{forward}
+		case -1:
+			headings = []float64{backward}
+		default:
+			// Prefer the heading that puts the rider on the curb side
+			if sideOfStreet(pickup, forward, source) == curbSide {
+				headings = []float64{forward, backward}
+			} else {
+				headings = []float64{backward, forward}
+			}
+		}
+
+		// Step 3. Keep the first heading that doesn't face away from the destination, at a curb it may stop at
+		toDestination := bearingDegrees(pickup, destination)
+		for _, heading := range headings {
+			if angleBetween(heading, toDestination) > ORIENTATION_MAX_ANGLE {
+				continue
+			}
+			if !isStoppingAllowedOn(way.Tags, curbSideOfWay(heading == forward)) {
+				continue
+			}
+
+			kept = append(kept, pickup)
+			orientations = append(orientations, PickupOrientation{
+				Heading: heading,
+				Side:    sideOfStreet(pickup, heading, source),
+			})
+			break
+		}
+	}
+
+	return kept, orientations
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestAngleBetween(t *testing.T) {
+	if response := angleBetween(350, 10); response != 20 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 20.0)
+	}
+}
+
+func TestOrientPickupPoints(t *testing.T) {
+	// An east-west street with the rider just south of it
+	west := Location{Latitude: 30.6, Longitude: -96.31}
+	east := Location{Latitude: 30.6, Longitude: -96.29}
+	pickup := Location{Latitude: 30.6, Longitude: -96.3}
+	source := Location{Latitude: 30.599, Longitude: -96.3}
+	streets := []Way{NewWay(1, []Location{west, east}, nil)}
+
+	// Heading east puts the rider (south) on the curb side
+	kept, orientations := orientPickupPoints([]Location{pickup}, source, Location{Latitude: 30.6, Longitude: -96.2}, streets)
+	if len(kept) != 1 || orientations[0].Heading != 90 || orientations[0].Side != "right" {
+		t.Errorf("Fail: unexpected orientation %+v", orientations)
+	}
+
+	// Destination to the west: the car pulls up on the far side instead
+	kept, orientations = orientPickupPoints([]Location{pickup}, source, Location{Latitude: 30.6, Longitude: -96.4}, streets)
+	if len(kept) != 1 || orientations[0].Heading != 270 || orientations[0].Side != "left" {
+		t.Errorf("Fail: unexpected orientation %+v", orientations)
+	}
+
+	// No stopping on the south curb (the way's right), so heading east can't pull up to it, and the rider crosses
+	streets[0] = NewWay(1, []Location{west, east}, map[string]string{"parking:right:restriction": "no_stopping"})
+	kept, orientations = orientPickupPoints([]Location{pickup}, source, Location{Latitude: 30.7, Longitude: -96.3}, streets)
+	if len(kept) != 1 || orientations[0].Heading != 270 || orientations[0].Side != "left" {
+		t.Errorf("Fail: expected the car to pull up to the north curb, got %+v", orientations)
+	}
+
+	// One-way eastbound with the destination to the west: dropped
+	streets[0] = NewWay(1, []Location{west, east}, map[string]string{"oneway": "yes"})
+	kept, _ = orientPickupPoints([]Location{pickup}, source, Location{Latitude: 30.6, Longitude: -96.4}, streets)
+	if len(kept) != 0 {
+		t.Errorf("Fail: expected pickup facing away to be dropped")
+	}
+}
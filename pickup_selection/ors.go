@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/valyala/fastjson"
@@ -16,16 +18,124 @@ func CeilToInt(x float64) int {
 	return int(math.Ceil(x))
 }
 
-// Function to call the OpenRouteService to get all source->destination pair walking info
-func ORSMatrix(sources []Location, destinations []Location, APIURL string) []Route {
-	// If source empty, return empty
-	if len(sources) == 0 {
-		return []Route{}
+// Function to get all source->destination pair walking info, going through cache first.
+// Walks don't depend on traffic, so they're cached for a long time (ORS_TTL).
+// Returns routes in row-major order, like the ORS matrix, and whether each cell could be walked
+// (cells ORS can't walk are never cached).
+func ORSMatrix(cache RouteCache, sources []Location, destinations []Location, APIURL string) ([]Route, []bool, error) {
+	// If either side empty, return empty
+	if len(sources) == 0 || len(destinations) == 0 {
+		return []Route{}, []bool{}, nil
+	}
+
+	// Get ttl setting
+	ttl, err := strconv.Atoi(os.Getenv("ORS_TTL"))
+	if err != nil {
+		// Default to 1 week ttl
+		ttl = 60 * 60 * 24 * 7
+	}
+
+	// Step 1. Pull every cell from cache at once
+	keys := make([]string, 0, len(sources)*len(destinations))
+	for _, source := range sources {
+		for _, destination := range destinations {
+			keys = append(keys, routeCacheKey("ors", source, -1, destination))
+		}
+	}
+	span := startSpan("cache.get")
+	span.SetAttr("prefix", "ors")
+	values := cache.GetMulti(keys)
+	span.End()
+	recordCacheLookups("ors", len(values), len(keys)-len(values))
+
+	// Step 2. Find the sources with any missing cell
+	routes := make([]Route, len(keys))
+	walked := make([]bool, len(keys))
+	var missedSrcs []int
+	for i, source := range sources {
+		missed := false
+		for j, destination := range destinations {
+			cell := i*len(destinations) + j
+			var route *Route
+			if data, ok := values[keys[cell]]; ok {
+				route = ParseRouteJSON(data, source, destination)
+			}
+			if route == nil {
+				missed = true
+				break
+			}
+			routes[cell] = *route
+			walked[cell] = true
+		}
+		if missed {
+			missedSrcs = append(missedSrcs, i)
+		}
+	}
+
+	// If there were no missed sources, simply return routes
+	if len(missedSrcs) == 0 {
+		return routes, walked, nil
+	}
+
+	// Step 3. Walk the missed sources to every destination
+	var missedSources []Location
+	for _, i := range missedSrcs {
+		missedSources = append(missedSources, sources[i])
 	}
+	// (concurrent requests for the same walks share one call, and only it stores them)
+	shared, err := orsFlights.Do(orsFlightKey(missedSources, destinations, APIURL), func() (interface{}, error) {
+		newRoutes, newWalked, err := fetchORSMatrix(cache, missedSources, destinations, APIURL)
+		if err != nil {
+			return nil, err
+		}
 
-	// If destination empty, return empty
-	if len(destinations) == 0 {
-		return []Route{}
+		// Step 4. Store the new walks in cache in the background (leaving out the ones ORS couldn't walk)
+		var stored []Route
+		for k, route := range newRoutes {
+			if newWalked[k] {
+				stored = append(stored, route)
+			}
+		}
+		StoreRoutesAsync(cache, "ors", stored, nil, FixedTTL(int32(ttl)))
+		return orsMatrix{Routes: newRoutes, Walked: newWalked}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	matrix := shared.(orsMatrix)
+	for k, route := range matrix.Routes {
+		cell := missedSrcs[k/len(destinations)]*len(destinations) + k%len(destinations)
+		routes[cell] = route
+		walked[cell] = matrix.Walked[k]
+	}
+
+	return routes, walked, nil
+}
+
+// An ORS matrix call's result, shared by every request waiting on it
+type orsMatrix struct {
+	Routes []Route
+	Walked []bool
+}
+
+// Helper function to get the key an ORS matrix call is coalesced under
+func orsFlightKey(sources []Location, destinations []Location, APIURL string) string {
+	hash := fnv.New64a()
+	io.WriteString(hash, APIURL)
+	for _, location := range append(append([]Location{}, sources...), destinations...) {
+		fmt.Fprintf(hash, "|%.6f,%.6f", location.Latitude, location.Longitude)
+	}
+	fmt.Fprintf(hash, "|%d", len(sources))
+	return fmt.Sprintf("ors_%x", hash.Sum64())
+}
+
+// Function to call the OpenRouteService to get all source->destination pair walking info
+// (the call is counted against today's quota in cache)
+// Returns routes in row-major order, and whether each cell could be walked (ORS sends null for those it can't).
+func fetchORSMatrix(cache RouteCache, sources []Location, destinations []Location, APIURL string) ([]Route, []bool, error) {
+	// If either side empty, return empty
+	if len(sources) == 0 || len(destinations) == 0 {
+		return []Route{}, []bool{}, nil
 	}
 
 	// Create request body
@@ -79,11 +189,12 @@ func ORSMatrix(sources []Location, destinations []Location, APIURL string) []Rou
 	} else {
 		url = APIURL
 	}
+	stageLog("ors").Info("requesting walks", "sources", len(sources), "destinations", len(destinations))
+
 	// Set the HTTP header Authorization to API Key
 	req, err := http.NewRequest("POST", url, strings.NewReader(requestBody))
 	if err != nil {
-		fmt.Printf("Error creating http request: %s", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("creating http request: %w", err)
 	}
 
 	// Set the content type
@@ -91,43 +202,67 @@ func ORSMatrix(sources []Location, destinations []Location, APIURL string) []Rou
 	req.Header.Add("Authorization", os.Getenv("ORS_API_KEY"))
 
 	// Make the request
+	span := startSpan("ors.matrix")
+	span.SetAttr("cells", strconv.Itoa(len(sources)*len(destinations)))
+	defer span.End()
 	res, err := http.DefaultClient.Do(req)
+	recordUpstream("ors", res, err)
 	if err != nil {
-		fmt.Printf("Error making http request: %s", err)
-		os.Exit(1)
+		span.SetError(err)
+		return nil, nil, fmt.Errorf("making http request: %w", err)
 	}
+	defer res.Body.Close()
 
 	// Decode the response
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("Error reading response body: %s", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("reading ORS response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("ORS returned status %d", res.StatusCode)
 	}
+	recordBillable(cache, "ors", 1)
 
 	// Unpack JSON
 	var p fastjson.Parser
 	v, err := p.Parse(string(resBody))
 	if err != nil {
-		fmt.Printf("Error reading response JSON: %s", err)
-		os.Exit(1)
-	}
-
-	// Get routes
-	var routes []Route
-	for i, row := range v.GetArray("durations") {
-		for j, cell := range row.GetArray() {
-			// Get v["distances"][i][j] as float64
-			length := CeilToInt(v.GetArray("distances")[i].GetArray()[j].GetFloat64())
-			duration := CeilToInt(cell.GetFloat64())
-
-			routes = append(routes, Route{
-				Source:                sources[i],
-				Destination:           destinations[j],
-				LengthInMeters:        length,
-				TravelTimeInSeconds:   duration,
-				TrafficDelayInSeconds: 0, // unsupported for walking
-			})
+		return nil, nil, fmt.Errorf("parsing ORS response: %w", err)
+	}
+
+	// Get routes (the matrix must have a row per source and a cell per destination)
+	durations := v.GetArray("durations")
+	distances := v.GetArray("distances")
+	if len(durations) != len(sources) || len(distances) != len(sources) {
+		return nil, nil, fmt.Errorf("ORS returned %d duration and %d distance rows for %d sources", len(durations), len(distances), len(sources))
+	}
+	routes := make([]Route, 0, len(sources)*len(destinations))
+	walked := make([]bool, 0, len(sources)*len(destinations))
+	for i := range sources {
+		durationRow := durations[i].GetArray()
+		distanceRow := distances[i].GetArray()
+		if len(durationRow) != len(destinations) || len(distanceRow) != len(destinations) {
+			return nil, nil, fmt.Errorf("ORS returned a row of %d cells for %d destinations", len(durationRow), len(destinations))
+		}
+		for j := range destinations {
+			route := Route{
+				Source:      sources[i],
+				Destination: destinations[j],
+			}
+
+			// Unreachable cells are null
+			if durationRow[j].Type() != fastjson.TypeNumber || distanceRow[j].Type() != fastjson.TypeNumber {
+				routes = append(routes, route)
+				walked = append(walked, false)
+				continue
+			}
+
+			route.LengthInMeters = CeilToInt(distanceRow[j].GetFloat64())
+			route.TravelTimeInSeconds = CeilToInt(durationRow[j].GetFloat64())
+			route.TrafficDelayInSeconds = 0 // unsupported for walking
+			routes = append(routes, route)
+			walked = append(walked, true)
 		}
 	}
-	return routes
+	return routes, walked, nil
 }
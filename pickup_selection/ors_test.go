@@ -42,9 +42,93 @@ func TestORSMatrix(t *testing.T) {
 		{Latitude: 30.625016382236353, Longitude: -96.4260441554713},
 		{Latitude: 30.516016382236353, Longitude: -96.3370441554713},
 	}
-	routes := ORSMatrix(test_sources, test_destinations, ThirdPartyURL)
+	routes, walked, err := ORSMatrix(NewLRUCache(10), test_sources, test_destinations, ThirdPartyURL)
 
-	if routes == nil {
-		t.Errorf("Error Posting request to ORS API. Result was nil")
+	if err != nil || len(routes) != 16 || !walked[15] {
+		t.Errorf("Error Posting request to ORS API. Got %d routes (%v)", len(routes), err)
+	}
+}
+
+func TestORSMatrixCache(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(200)
+		w.Write([]byte(`{"durations":[[120.2]],"distances":[[150.5]]}`))
+	}))
+	defer ts.Close()
+
+	cache := NewLRUCache(10)
+	sources := []Location{{Latitude: 30.6161, Longitude: -96.3371}}
+	destinations := []Location{{Latitude: 30.6181, Longitude: -96.3465}}
+
+	// First time asks ORS, second time is from cache
+	for attempt := 0; attempt < 2; attempt++ {
+		routes, walked, err := ORSMatrix(cache, sources, destinations, ts.URL)
+		FlushCacheWrites()
+		if err != nil || len(routes) != 1 || !walked[0] || routes[0].TravelTimeInSeconds != 121 || routes[0].LengthInMeters != 151 {
+			t.Errorf("Fail: unexpected routes %+v", routes)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Fail: expected 1 ORS request, got %d", requests)
+	}
+}
+
+func TestORSMatrixUnreachable(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(200)
+		w.Write([]byte(`{"durations":[[120.2,null]],"distances":[[150.5,null]]}`))
+	}))
+	defer ts.Close()
+
+	cache := NewLRUCache(10)
+	sources := []Location{{Latitude: 30.6161, Longitude: -96.3371}}
+	destinations := []Location{{Latitude: 30.6181, Longitude: -96.3465}, {Latitude: 30.7, Longitude: -96.4}}
+
+	// Null cells can't be walked, and are never cached (so both attempts ask ORS)
+	for attempt := 0; attempt < 2; attempt++ {
+		routes, walked, err := ORSMatrix(cache, sources, destinations, ts.URL)
+		FlushCacheWrites()
+		if err != nil || len(routes) != 2 || !walked[0] || walked[1] || routes[0].TravelTimeInSeconds != 121 {
+			t.Errorf("Fail: expected the second cell unwalked, got %+v %v (%v)", routes, walked, err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Fail: expected 2 ORS requests, got %d", requests)
+	}
+	if GetRoute(cache, "ors", sources[0], destinations[1]) != nil {
+		t.Errorf("Fail: expected the unwalked cell not to be cached")
+	}
+}
+
+func TestORSMatrixErrors(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusForbidden, `{"error":"Access to this API has been disallowed"}`},
+		{http.StatusOK, `{"error":"no matrix"}`},
+		{http.StatusOK, `{"durations":[[120.2,60]],"distances":[[150.5]]}`},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+
+		// Errors (and nothing cached) instead of zero-length walks
+		cache := NewLRUCache(10)
+		sources := []Location{{Latitude: 30.6161, Longitude: -96.3371}}
+		destinations := []Location{{Latitude: 30.6181, Longitude: -96.3465}, {Latitude: 30.7, Longitude: -96.4}}
+		if _, _, err := ORSMatrix(cache, sources, destinations, ts.URL); err == nil {
+			t.Errorf("Fail: expected an error for %d %s", test.status, test.body)
+		}
+		FlushCacheWrites()
+		if GetRoute(cache, "ors", sources[0], destinations[0]) != nil {
+			t.Errorf("Fail: expected nothing cached for %d %s", test.status, test.body)
+		}
+		ts.Close()
 	}
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+
+	"github.com/paulmach/osm"
+	"github.com/paulmach/osm/osmpbf"
+)
+
+// Constant for the size of a spatial index cell (in degrees, roughly 0.7mi)
+const OSM_INDEX_CELL_DEGREES float64 = 0.01
+
+// A cell in the spatial index
+type osmIndexCell struct {
+	X int
+	Y int
+}
+
+// Street (and POI) source backed by a local OSM PBF extract, loaded into in-memory grid indexes.
+// Only the highway classes from extractHighwayClasses are kept, as a whole state's streets don't fit in memory.
+type StreetExtract struct {
+	ways     []Way
+	boxes    [][4]float64 // (left, bottom, right, top) of each way
+	cells    map[osmIndexCell][]int
+	classes  map[string]bool
+	pois     []PointOfInterest
+	poiCells map[osmIndexCell][]int
+}
+
+// Function to get a new, empty StreetExtract keeping the given highway classes
+func newStreetExtract(classes []string) *StreetExtract {
+	extract := &StreetExtract{
+		cells:    make(map[osmIndexCell][]int),
+		classes:  make(map[string]bool),
+		poiCells: make(map[osmIndexCell][]int),
+	}
+	for _, class := range classes {
+		extract.classes[class] = true
+	}
+	return extract
+}
+
+// Helper function to get the highway classes loaded from an extract, from OSM_EXTRACT_HIGHWAY_CLASSES
+// or the deployment's street query (see resolveStreetQuery) plus the walkways the isochrone generator walks on.
+// Requests can only ask for these.
+func extractHighwayClasses() []string {
+	if classes := splitEnvList("OSM_EXTRACT_HIGHWAY_CLASSES"); classes != nil {
+		return classes
+	}
+	return append(append([]string{}, resolveStreetQuery(nil).HighwayClasses...), WALKWAY_HIGHWAY_CLASSES...)
+}
+
+// Helper function to get the index cell containing a coordinate
+func cellFor(longitude float64, latitude float64) osmIndexCell {
+	return osmIndexCell{
+		X: int(math.Floor(longitude / OSM_INDEX_CELL_DEGREES)),
+		Y: int(math.Floor(latitude / OSM_INDEX_CELL_DEGREES)),
+	}
+}
+
+// Load the streets (of the classes from extractHighwayClasses) and points of interest from an OSM PBF
+// extract (e.g. texas-latest.osm.pbf) into a StreetExtract.
+// Takes two passes over the file: one for the ways, one for the nodes (their coordinates, and POI nodes).
+// POIs mapped as relations aren't loaded.
+func LoadStreetExtract(path string) (*StreetExtract, error) {
+	extract := newStreetExtract(extractHighwayClasses())
+
+	// Pass 1. Collect street and POI ways, and the nodes they need
+	var osmWays, poiWays []*osm.Way
+	neededNodes := make(map[osm.NodeID]Location)
+	err := scanExtract(path, func(scanner *osmpbf.Scanner) {
+		scanner.SkipNodes = true
+		scanner.SkipRelations = true
+	}, func(object osm.Object) {
+		way := object.(*osm.Way)
+		switch {
+		case extract.classes[way.Tags.Find("highway")]:
+			osmWays = append(osmWays, way)
+		case isPointOfInterest(way.Tags.Map(), false):
+			poiWays = append(poiWays, way)
+		default:
+			return
+		}
+		for _, node := range way.Nodes {
+			neededNodes[node.ID] = Location{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Pass 2. Fill in the node coordinates, and collect POI nodes
+	err = scanExtract(path, func(scanner *osmpbf.Scanner) {
+		scanner.SkipWays = true
+		scanner.SkipRelations = true
+	}, func(object osm.Object) {
+		node := object.(*osm.Node)
+		location := Location{Latitude: node.Lat, Longitude: node.Lon}
+		if _, ok := neededNodes[node.ID]; ok {
+			neededNodes[node.ID] = location
+		}
+		if len(node.Tags) > 0 && isPointOfInterest(node.Tags.Map(), true) {
+			extract.addPOI(newPointOfInterest(location, node.Tags.Map()))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build ways + index
+	wayGeometry := func(osmWay *osm.Way) []Location {
+		geometry := make([]Location, len(osmWay.Nodes))
+		for i, node := range osmWay.Nodes {
+			geometry[i] = neededNodes[node.ID]
+		}
+		return geometry
+	}
+	for _, osmWay := range osmWays {
+		extract.add(NewWay(int64(osmWay.ID), wayGeometry(osmWay), osmWay.Tags.Map()))
+	}
+
+	// POI ways are placed at the center of their bounding box, like Overpass's "out center"
+	for _, osmWay := range poiWays {
+		geometry := wayGeometry(osmWay)
+		if len(geometry) == 0 {
+			continue
+		}
+		box := wayBoundingBox(Way{Geometry: geometry})
+		center := Location{Latitude: (box[1] + box[3]) / 2, Longitude: (box[0] + box[2]) / 2}
+		extract.addPOI(newPointOfInterest(center, osmWay.Tags.Map()))
+	}
+
+	return extract, nil
+}
+
+// Helper function to run one pass over a PBF file
+func scanExtract(path string, configure func(*osmpbf.Scanner), visit func(osm.Object)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening OSM extract: %w", err)
+	}
+	defer file.Close()
+
+	scanner := osmpbf.New(context.Background(), file, runtime.GOMAXPROCS(0))
+	defer scanner.Close()
+	configure(scanner)
+
+	for scanner.Scan() {
+		visit(scanner.Object())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading OSM extract: %w", err)
+	}
+	return nil
+}
+
+// Helper function to get the (left, bottom, right, top) bounding box of a way
+func wayBoundingBox(way Way) [4]float64 {
+	box := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, node := range way.Geometry {
+		box[0] = math.Min(box[0], node.Longitude)
+		box[1] = math.Min(box[1], node.Latitude)
+		box[2] = math.Max(box[2], node.Longitude)
+		box[3] = math.Max(box[3], node.Latitude)
+	}
+	return box
+}
+
+// Helper function to add a way to the extract and its index
+func (extract *StreetExtract) add(way Way) {
+	if len(way.Geometry) == 0 {
+		return
+	}
+
+	// Get the way's bounding box
+	box := wayBoundingBox(way)
+
+	// Store the way
+	index := len(extract.ways)
+	extract.ways = append(extract.ways, way)
+	extract.boxes = append(extract.boxes, box)
+
+	// Add it to every cell its bounding box covers
+	low := cellFor(box[0], box[1])
+	high := cellFor(box[2], box[3])
+	for x := low.X; x <= high.X; x++ {
+		for y := low.Y; y <= high.Y; y++ {
+			cell := osmIndexCell{X: x, Y: y}
+			extract.cells[cell] = append(extract.cells[cell], index)
+		}
+	}
+}
+
+// Helper function to add a point of interest to the extract and its index
+func (extract *StreetExtract) addPOI(poi PointOfInterest) {
+	cell := cellFor(poi.Location.Longitude, poi.Location.Latitude)
+	extract.poiCells[cell] = append(extract.poiCells[cell], len(extract.pois))
+	extract.pois = append(extract.pois, poi)
+}
+
+// Function to get streets from the local extract
+func (extract *StreetExtract) GetStreets(radius float64, center Location, streetQuery StreetQuery) ([]Way, error) {
+	// Same validation as Overpass
+	if len(streetQuery.HighwayClasses) == 0 {
+		return nil, fmt.Errorf("no highway classes to query")
+	}
+
+	// Only the loaded classes can be asked for
+	for _, class := range streetQuery.HighwayClasses {
+		if !extract.classes[class] {
+			return nil, fmt.Errorf("highway class %q is not loaded from the local extract (see OSM_EXTRACT_HIGHWAY_CLASSES)", class)
+		}
+	}
+	filters, err := parseTagFilters(streetQuery.ExtraFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get bounding box (in two halves across the antimeridian)
+	left, bottom, right, top := getUserBoundingBox(radius, center)
+
+	// Look through every cell the bounding box covers
+	var ways []Way
+	seen := make(map[int]bool)
+	for _, bbox := range splitAtAntimeridian(left, bottom, right, top) {
+		low := cellFor(bbox[0], bbox[1])
+		high := cellFor(bbox[2], bbox[3])
+		for x := low.X; x <= high.X; x++ {
+			for y := low.Y; y <= high.Y; y++ {
+				for _, index := range extract.cells[osmIndexCell{X: x, Y: y}] {
+					if seen[index] {
+						continue
+					}
+
+					// Must overlap the bounding box
+					if !boxesOverlap(extract.boxes[index], bbox) {
+						continue
+					}
+					seen[index] = true
+
+					// Must match the query
+					if !matchesStreetQuery(extract.ways[index].Tags, streetQuery, filters) {
+						continue
+					}
+
+					ways = append(ways, extract.ways[index])
+				}
+			}
+		}
+	}
+
+	return ways, nil
+}
+
+// Function to get named points of interest and addresses from the local extract
+func (extract *StreetExtract) GetPointsOfInterest(radius float64, center Location) ([]PointOfInterest, error) {
+	// Get bounding box (in two halves across the antimeridian)
+	left, bottom, right, top := getUserBoundingBox(radius, center)
+
+	// Look through every cell the bounding box covers
+	var pois []PointOfInterest
+	for _, bbox := range splitAtAntimeridian(left, bottom, right, top) {
+		low := cellFor(bbox[0], bbox[1])
+		high := cellFor(bbox[2], bbox[3])
+		for x := low.X; x <= high.X; x++ {
+			for y := low.Y; y <= high.Y; y++ {
+				for _, index := range extract.poiCells[osmIndexCell{X: x, Y: y}] {
+					poi := extract.pois[index]
+					if poi.Location.Longitude >= bbox[0] && poi.Location.Longitude <= bbox[2] && poi.Location.Latitude >= bbox[1] && poi.Location.Latitude <= bbox[3] {
+						pois = append(pois, poi)
+					}
+				}
+			}
+		}
+	}
+
+	return pois, nil
+}
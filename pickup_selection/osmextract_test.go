@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestStreetExtractGetStreets(t *testing.T) {
+	center := Location{Latitude: 30.616, Longitude: -96.337}
+	extract := newStreetExtract(DEFAULT_HIGHWAY_CLASSES)
+
+	// Inside the box
+	extract.add(Way{Geometry: []Location{{Latitude: 30.615, Longitude: -96.34}, {Latitude: 30.617, Longitude: -96.33}}, Tags: map[string]string{"highway": "residential"}})
+	// Inside the box, but a driveway
+	extract.add(Way{Geometry: []Location{{Latitude: 30.615, Longitude: -96.338}, {Latitude: 30.616, Longitude: -96.338}}, Tags: map[string]string{"highway": "service", "service": "driveway"}})
+	// Crosses the box with no nodes inside it
+	extract.add(Way{Geometry: []Location{{Latitude: 30.5, Longitude: -96.337}, {Latitude: 30.7, Longitude: -96.337}}, Tags: map[string]string{"highway": "primary"}})
+	// Outside the box
+	extract.add(Way{Geometry: []Location{{Latitude: 31.0, Longitude: -96.0}, {Latitude: 31.1, Longitude: -96.0}}, Tags: map[string]string{"highway": "primary"}})
+
+	ways, err := extract.GetStreets(1, center, StreetQuery{
+		HighwayClasses: DEFAULT_HIGHWAY_CLASSES,
+		ExcludedTags:   DEFAULT_EXCLUDED_TAGS,
+	})
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(ways) != 2 {
+		t.Errorf("Fail: expected 2 streets, got %d", len(ways))
+	}
+
+	// Extra filters are evaluated locally
+	ways, _ = extract.GetStreets(1, center, StreetQuery{
+		HighwayClasses: DEFAULT_HIGHWAY_CLASSES,
+		ExtraFilters:   []string{`["highway"!="primary"]`, `[!"service"]`},
+	})
+	if len(ways) != 1 || ways[0].Tags["highway"] != "residential" {
+		t.Errorf("Fail: unexpected streets %+v", ways)
+	}
+
+	// Classes that weren't loaded are an error
+	if _, err := extract.GetStreets(1, center, StreetQuery{HighwayClasses: []string{"footway"}}); err == nil {
+		t.Errorf("Fail: expected an error for a class that wasn't loaded")
+	}
+
+	// Unsupported filters are an error
+	if _, err := extract.GetStreets(1, center, StreetQuery{HighwayClasses: DEFAULT_HIGHWAY_CLASSES, ExtraFilters: []string{`["name"~"^A"]`}}); err == nil {
+		t.Errorf("Fail: expected an error for a regex filter")
+	}
+}
+
+func TestStreetExtractGetPointsOfInterest(t *testing.T) {
+	center := Location{Latitude: 30.616, Longitude: -96.337}
+	extract := newStreetExtract(DEFAULT_HIGHWAY_CLASSES)
+
+	// Inside the box, and outside it
+	extract.addPOI(newPointOfInterest(Location{Latitude: 30.6161, Longitude: -96.3371}, map[string]string{"amenity": "taxi"}))
+	extract.addPOI(newPointOfInterest(Location{Latitude: 31.0, Longitude: -96.0}, map[string]string{"shop": "coffee", "name": "Far Away"}))
+
+	pois, err := extract.GetPointsOfInterest(1, center)
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(pois) != 1 || pois[0].Kind != "taxi" {
+		t.Errorf("Fail: expected the taxi stand only, got %+v", pois)
+	}
+}
+
+func TestIsPointOfInterest(t *testing.T) {
+	cases := []struct {
+		tags map[string]string
+		node bool
+		want bool
+	}{
+		{map[string]string{"amenity": "taxi"}, false, true},
+		{map[string]string{"highway": "bus_stop"}, true, true},
+		{map[string]string{"highway": "bus_stop"}, false, false},
+		{map[string]string{"shop": "coffee"}, true, false},
+		{map[string]string{"addr:housenumber": "1702", "addr:street": "George Bush Drive"}, false, true},
+		{map[string]string{"highway": "residential"}, false, false},
+	}
+	for _, c := range cases {
+		if got := isPointOfInterest(c.tags, c.node); got != c.want {
+			t.Errorf("Fail: expected %v for %v (node %v), got %v", c.want, c.tags, c.node, got)
+		}
+	}
+}
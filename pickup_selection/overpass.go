@@ -1,96 +1,422 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/valyala/fastjson"
 )
 
+// Which streets to fetch from OpenStreetMap.
+// Can be set per deployment (OSM_* environment variables) and overridden per request.
+type StreetQuery struct {
+	// highway=* values to include (e.g. "primary", "residential")
+	HighwayClasses []string `json:"highwayClasses,omitempty"`
+	// key=value tags that exclude a way (e.g. "service=driveway", "access=private")
+	ExcludedTags []string `json:"excludedTags,omitempty"`
+	// Extra Overpass QL filters appended to the way selector (e.g. `[surface!="unpaved"]`)
+	ExtraFilters []string `json:"extraFilters,omitempty"`
+}
+
+// Constant for the default highway classes to fetch
+var DEFAULT_HIGHWAY_CLASSES []string = []string{"primary", "secondary", "tertiary", "residential", "service", "unclassified"}
+
+// Constant for the default tags that exclude a way
+var DEFAULT_EXCLUDED_TAGS []string = []string{"service=driveway", "service=parking_aisle", "access=private"}
+
+// Helper function to split a comma separated environment variable (nil if unset)
+func splitEnvList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Function to get the deployment's street query, overridden by any fields set in the request
+func resolveStreetQuery(requestQuery *StreetQuery) StreetQuery {
+	// Start with the defaults
+	query := StreetQuery{
+		HighwayClasses: DEFAULT_HIGHWAY_CLASSES,
+		ExcludedTags:   DEFAULT_EXCLUDED_TAGS,
+	}
+
+	// Apply deployment settings
+	if classes := splitEnvList("OSM_HIGHWAY_CLASSES"); classes != nil {
+		query.HighwayClasses = classes
+	}
+	if excluded := splitEnvList("OSM_EXCLUDED_TAGS"); excluded != nil {
+		query.ExcludedTags = excluded
+	}
+	if filters := os.Getenv("OSM_EXTRA_FILTERS"); filters != "" {
+		query.ExtraFilters = []string{filters}
+	}
+
+	// Apply request settings
+	if requestQuery != nil {
+		if len(requestQuery.HighwayClasses) > 0 {
+			query.HighwayClasses = requestQuery.HighwayClasses
+		}
+		if len(requestQuery.ExcludedTags) > 0 {
+			query.ExcludedTags = requestQuery.ExcludedTags
+		}
+		if len(requestQuery.ExtraFilters) > 0 {
+			query.ExtraFilters = requestQuery.ExtraFilters
+		}
+	}
+
+	return query
+}
+
+// Helper function to escape a string for use inside a quoted Overpass QL value
+func overpassEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+}
+
+// Helper function to escape a highway class for use inside an Overpass QL regex
+func overpassRegexEscape(value string) string {
+	return overpassEscape(regexp.QuoteMeta(value))
+}
+
+// Build the Overpass QL to fetch the streets matching a StreetQuery within a bounding box
+func buildStreetQuery(streetQuery StreetQuery, bottom float64, left float64, top float64, right float64) (string, error) {
+	// Step 1. Need at least one highway class
+	if len(streetQuery.HighwayClasses) == 0 {
+		return "", fmt.Errorf("no highway classes to query")
+	}
+
+	// Step 2. Select all highway classes at once with a regex
+	classes := make([]string, len(streetQuery.HighwayClasses))
+	for i, class := range streetQuery.HighwayClasses {
+		classes[i] = overpassRegexEscape(class)
+	}
+	selector := fmt.Sprintf(`way["highway"~"^(%s)$"]`, strings.Join(classes, "|"))
+
+	// Step 3. Exclude tags (a missing key also passes != in Overpass)
+	for _, tag := range streetQuery.ExcludedTags {
+		key, value, found := strings.Cut(tag, "=")
+		if !found || key == "" {
+			return "", fmt.Errorf("excluded tag %q is not key=value", tag)
+		}
+		selector += fmt.Sprintf(`["%s"!="%s"]`, overpassEscape(key), overpassEscape(value))
+	}
+
+	// Step 4. Add extra filters, which must be plain [...] tag filters
+	for _, filter := range streetQuery.ExtraFilters {
+		if !strings.HasPrefix(filter, "[") || !strings.HasSuffix(filter, "]") || strings.ContainsAny(filter, ";()") {
+			return "", fmt.Errorf("extra filter %q is not a [...] tag filter", filter)
+		}
+		selector += filter
+	}
+
+	// Step 5. Finish the query
+	bbox := fmt.Sprintf("%f,%f,%f,%f", bottom, left, top, right)
+	return fmt.Sprintf(`
+		[out:json];
+		%s(%s);
+		out geom;`,
+		selector, bbox), nil
+}
+
 // Get street geometry via Overpass API and OpenStreetMap
-func getStreetGeometry(radius float64, center Location, test_APIURL string) [][]Location {
+func getStreetGeometry(radius float64, center Location, streetQuery StreetQuery, test_APIURL string) ([]Way, error) {
 	// Get bounding box
 	left, bottom, right, top := getUserBoundingBox(radius, center)
 
+	// Query each half across the antimeridian (keeping one copy of a street in both)
+	var ways []Way
+	seen := make(map[int64]bool)
+	for _, box := range splitAtAntimeridian(left, bottom, right, top) {
+		boxWays, err := getStreetGeometryInBox(streetQuery, box[1], box[0], box[3], box[2], test_APIURL)
+		if err != nil {
+			return nil, err
+		}
+		for _, way := range boxWays {
+			if !seen[way.ID] {
+				seen[way.ID] = true
+				ways = append(ways, way)
+			}
+		}
+	}
+	return ways, nil
+}
+
+// Get street geometry within a (bottom, left, top, right) bounding box via Overpass API
+func getStreetGeometryInBox(streetQuery StreetQuery, bottom float64, left float64, top float64, right float64, test_APIURL string) ([]Way, error) {
 	// Query OSM for streets within the bounding box
-	bbox := fmt.Sprintf("%f,%f,%f,%f", bottom, left, top, right)
-	query := fmt.Sprintf(`
-		[out:json];
-		(
-			way["highway"="primary"](%s);
-			way["highway"="secondary"](%s);
-			way["highway"="tertiary"](%s);
-			way["highway"="residential"](%s);
-			way["highway"="service"](%s);
-			way["highway"="unclassified"](%s);
-		);
-		out geom;`,
-		bbox, bbox, bbox, bbox, bbox, bbox)
+	query, err := buildStreetQuery(streetQuery, bottom, left, top, right)
+	if err != nil {
+		return nil, err
+	}
 
 	// Make the request
-	q := make(url.Values)
-	q.Set("data", query)
+	v, err := queryOverpass(query, test_APIURL)
+	if err != nil {
+		return nil, err
+	}
 
-	apiURL := &url.URL{
-		Scheme:   "https",
-		Host:     "overpass-api.de",
-		Path:     "/api/interpreter",
-		RawQuery: q.Encode(),
+	// Decode response JSON (elements only)
+	var ways []Way
+
+	// Unpack each street's line segments and tags
+	// elements: Street[]
+	// Street = { id: number, geometry: []{ lat: number, lon: number }, tags: { [key]: string } }
+	for _, street := range v.GetArray("elements") {
+		var streetGeometry []Location
+		for _, coords := range street.GetArray("geometry") {
+			streetGeometry = append(streetGeometry, Location{
+				Latitude:  coords.GetFloat64("lat"),
+				Longitude: coords.GetFloat64("lon"),
+			})
+		}
+
+		ways = append(ways, NewWay(street.GetInt64("id"), streetGeometry, parseOverpassTags(street)))
 	}
 
-	var url string
-	if test_APIURL == "nil" {
-		url = apiURL.String()
-	} else {
-		url = test_APIURL
+	return ways, nil
+}
+
+// Constant for the default Overpass endpoints, tried in order
+var DEFAULT_OVERPASS_URLS []string = []string{
+	"https://overpass-api.de/api/interpreter",
+	"https://overpass.kumi.systems/api/interpreter",
+	"https://overpass.private.coffee/api/interpreter",
+}
+
+// Constant for how long an endpoint rests after a failure without Retry-After (doubles each failure)
+const OVERPASS_BASE_BACKOFF time.Duration = 5 * time.Second
+
+// Constant for the longest an endpoint is rested for
+const OVERPASS_MAX_BACKOFF time.Duration = 5 * time.Minute
+
+// Constant for how long an Overpass request may take before giving up on it (and trying the next endpoint)
+const OVERPASS_TIMEOUT time.Duration = 10 * time.Second
+
+// HTTP client for Overpass requests
+var overpassClient = &http.Client{Timeout: OVERPASS_TIMEOUT}
+
+// Health of one Overpass endpoint
+type overpassEndpointHealth struct {
+	failures     int
+	restingUntil time.Time
+}
+
+// Health of every Overpass endpoint used so far (shared across requests in this container)
+var overpassHealth = make(map[string]*overpassEndpointHealth)
+var overpassHealthLock sync.Mutex
+
+// Helper function to get the configured Overpass endpoints
+func overpassURLs() []string {
+	if urls := splitEnvList("OVERPASS_URLS"); urls != nil {
+		return urls
+	}
+	return DEFAULT_OVERPASS_URLS
+}
+
+// Helper function to record a failed request to an endpoint.
+// retryAfter is how long the endpoint asked us to wait (0 to back off exponentially).
+func markOverpassFailure(endpoint string, retryAfter time.Duration) {
+	overpassHealthLock.Lock()
+	defer overpassHealthLock.Unlock()
+
+	health, ok := overpassHealth[endpoint]
+	if !ok {
+		health = &overpassEndpointHealth{}
+		overpassHealth[endpoint] = health
+	}
+	health.failures++
+
+	// Back off exponentially unless told how long to wait
+	if retryAfter <= 0 {
+		retryAfter = OVERPASS_BASE_BACKOFF << (health.failures - 1)
+	}
+	if retryAfter > OVERPASS_MAX_BACKOFF || retryAfter <= 0 {
+		retryAfter = OVERPASS_MAX_BACKOFF
+	}
+	health.restingUntil = time.Now().Add(retryAfter)
+}
+
+// Helper function to record a successful request to an endpoint
+func markOverpassSuccess(endpoint string) {
+	overpassHealthLock.Lock()
+	defer overpassHealthLock.Unlock()
+
+	delete(overpassHealth, endpoint)
+}
+
+// Helper function to get when an endpoint can be used again (zero time if healthy)
+func overpassRestingUntil(endpoint string) time.Time {
+	overpassHealthLock.Lock()
+	defer overpassHealthLock.Unlock()
+
+	if health, ok := overpassHealth[endpoint]; ok {
+		return health.restingUntil
 	}
+	return time.Time{}
+}
+
+// Helper function to parse a Retry-After header (seconds or HTTP date)
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
 
-	//req, err := http.NewRequest(http.MethodGet, apiURL.String(), nil)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// Error from an Overpass endpoint that means it should rest
+// (it couldn't be reached, is rate limiting us, or is failing)
+type overpassEndpointError struct {
+	err error
+	// How long the endpoint asked us to wait (0 if it didn't say)
+	retryAfter time.Duration
+}
+
+func (err *overpassEndpointError) Error() string {
+	return err.err.Error()
+}
+
+func (err *overpassEndpointError) Unwrap() error {
+	return err.err
+}
+
+// Helper function to make one request to one Overpass endpoint.
+// Returns the parsed response, or an error. Errors that should rest the endpoint are *overpassEndpointError;
+// the rest (a runtime error in the query, a query the endpoint refused) would come back the same from any endpoint.
+func tryOverpassEndpoint(endpoint string, query string) (*fastjson.Value, error) {
+	// Make the request
+	q := make(url.Values)
+	q.Set("data", query)
 
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
 	if err != nil {
-		fmt.Printf("Error creating http request: %s\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("creating http request: %w", err)
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	span := startSpan("overpass")
+	defer span.End()
+	res, err := overpassClient.Do(req)
+	recordUpstream("overpass", res, err)
 	if err != nil {
-		fmt.Printf("Error making http request: %s\n", err)
-		os.Exit(1)
+		span.SetError(err)
+		return nil, &overpassEndpointError{err: fmt.Errorf("making http request: %w", err)}
 	}
+	defer res.Body.Close()
 
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("Error reading in Overpass Response: %s\n", err)
-		os.Exit(1)
+		return nil, &overpassEndpointError{err: fmt.Errorf("reading Overpass response: %w", err)}
 	}
 
-	// Decode response JSON (elements only)
-	var geometries [][]Location
-	var p fastjson.Parser
+	// Rate limits and timeouts come back as HTML pages, not JSON
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return nil, &overpassEndpointError{
+			err:        fmt.Errorf("Overpass returned status %d", res.StatusCode),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Overpass returned status %d", res.StatusCode)
+	}
 
+	// Decode response JSON
+	var p fastjson.Parser
 	v, err := p.Parse(string(resBody))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("parsing Overpass response: %w", err)
 	}
 
-	// Unpack each street's line segments
-	// elements: Street[]
-	// Street = []{ lat: number, lon: number }
-	for _, street := range v.GetArray("elements") {
-		var streetGeometry []Location
-		for _, coords := range street.GetArray("geometry") {
-			streetGeometry = append(streetGeometry, Location{
-				Latitude:  coords.GetFloat64("lat"),
-				Longitude: coords.GetFloat64("lon"),
-			})
+	// Overpass reports query timeouts and out-of-memory as a runtime error in "remark"
+	if remark := string(v.GetStringBytes("remark")); strings.Contains(remark, "runtime error") {
+		return nil, fmt.Errorf("Overpass %s", remark)
+	}
+
+	return v, nil
+}
+
+// Helper function to run an Overpass QL query and parse the JSON response.
+// Concurrent requests for the same query share one call, each parsing its own copy
+// (fastjson values aren't safe to read side by side).
+func queryOverpass(query string, test_APIURL string) (*fastjson.Value, error) {
+	body, err := overpassFlights.Do(test_APIURL+"|"+query, func() (interface{}, error) {
+		v, err := fetchOverpass(query, test_APIURL)
+		if err != nil {
+			return nil, err
 		}
-		geometries = append(geometries, streetGeometry)
+		return string(v.MarshalTo(nil)), nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return fastjson.Parse(body.(string))
+}
 
-	return geometries
+// Helper function to run an Overpass QL query (no coalescing).
+// Tries each healthy endpoint once, in order, resting endpoints that fail or rate limit us.
+// Errors about the query itself (see tryOverpassEndpoint) are returned as-is, without resting the endpoint.
+// Fails straight away if every endpoint is resting, rather than holding the request up waiting for one.
+func fetchOverpass(query string, test_APIURL string) (*fastjson.Value, error) {
+	// Get the endpoints to try
+	var endpoints []string
+	if test_APIURL == "nil" {
+		endpoints = overpassURLs()
+	} else {
+		endpoints = []string{test_APIURL}
+	}
+
+	var lastErr error
+	for _, endpoint := range endpoints {
+		// Step 1. Skip endpoints that are resting
+		if time.Now().Before(overpassRestingUntil(endpoint)) {
+			continue
+		}
+
+		// Step 2. Try it
+		v, err := tryOverpassEndpoint(endpoint, query)
+		if err == nil {
+			markOverpassSuccess(endpoint)
+			return v, nil
+		}
+		stageLog("overpass").Warn("overpass error", "endpoint", endpoint, "error", err)
+
+		// Step 3. Rest it and try the next one if the endpoint is at fault, otherwise that's the answer
+		var endpointErr *overpassEndpointError
+		if !errors.As(err, &endpointErr) {
+			return nil, err
+		}
+		markOverpassFailure(endpoint, endpointErr.retryAfter)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("all endpoints are resting")
+	}
+	return nil, fmt.Errorf("no Overpass endpoint could answer: %w", lastErr)
+}
+
+// Helper function to unpack an Overpass element's tags into a map
+func parseOverpassTags(element *fastjson.Value) map[string]string {
+	tags := make(map[string]string)
+	if tagsObject := element.GetObject("tags"); tagsObject != nil {
+		tagsObject.Visit(func(key []byte, value *fastjson.Value) {
+			tags[string(key)] = string(value.GetStringBytes())
+		})
+	}
+	return tags
 }
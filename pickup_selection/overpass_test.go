@@ -1,7 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Tests all functions found in location.go
@@ -13,9 +17,124 @@ func TestGetStreetGeometry(t *testing.T) {
 		Latitude: 30.616016382236353, Longitude: -96.3370441554713,
 	}
 
-	geomtries := getStreetGeometry(1, test_source, "nil")
+	geomtries, _ := getStreetGeometry(1, test_source, resolveStreetQuery(nil), "nil")
 
 	if geomtries == nil {
 		t.Errorf("Error posting request to overpass API. Result was nil")
 	}
 }
+
+func TestBuildStreetQuery(t *testing.T) {
+	streetQuery := StreetQuery{
+		HighwayClasses: []string{"primary", "residential"},
+		ExcludedTags:   []string{"service=driveway", "access=private"},
+		ExtraFilters:   []string{`["surface"!="unpaved"]`},
+	}
+
+	query, err := buildStreetQuery(streetQuery, 30.1, -96.4, 30.2, -96.3)
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	expected := `way["highway"~"^(primary|residential)$"]["service"!="driveway"]["access"!="private"]["surface"!="unpaved"](30.100000,-96.400000,30.200000,-96.300000);`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Result was incorrect, got: %s, want: %s", query, expected)
+	}
+
+	// Reject filters that could end the statement
+	streetQuery.ExtraFilters = []string{`[x];out;`}
+	if _, err := buildStreetQuery(streetQuery, 30.1, -96.4, 30.2, -96.3); err == nil {
+		t.Errorf("Fail: expected an error for an unsafe filter")
+	}
+}
+
+func TestResolveStreetQuery(t *testing.T) {
+	t.Setenv("OSM_HIGHWAY_CLASSES", "primary, secondary")
+	t.Setenv("OSM_EXCLUDED_TAGS", "")
+
+	// Deployment settings apply, defaults fill the rest
+	query := resolveStreetQuery(nil)
+	if len(query.HighwayClasses) != 2 || query.HighwayClasses[1] != "secondary" {
+		t.Errorf("Fail: unexpected highway classes %v", query.HighwayClasses)
+	}
+	if len(query.ExcludedTags) != len(DEFAULT_EXCLUDED_TAGS) {
+		t.Errorf("Fail: unexpected excluded tags %v", query.ExcludedTags)
+	}
+
+	// Request settings override deployment settings
+	query = resolveStreetQuery(&StreetQuery{HighwayClasses: []string{"service"}})
+	if len(query.HighwayClasses) != 1 || query.HighwayClasses[0] != "service" {
+		t.Errorf("Fail: unexpected highway classes %v", query.HighwayClasses)
+	}
+}
+
+func TestQueryOverpassFailover(t *testing.T) {
+	// First mirror is rate limiting us
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(429)
+		w.Write([]byte(`<html>Too Many Requests</html>`))
+	}))
+	defer limited.Close()
+
+	// Second mirror works
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"elements":[{"type":"way","id":1}]}`))
+	}))
+	defer healthy.Close()
+
+	t.Setenv("OVERPASS_URLS", limited.URL+","+healthy.URL)
+	v, err := queryOverpass("[out:json];", "nil")
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(v.GetArray("elements")) != 1 {
+		t.Errorf("Fail: expected the healthy mirror's response")
+	}
+
+	// The rate limited mirror rests for as long as it asked
+	restingFor := time.Until(overpassRestingUntil(limited.URL))
+	if restingFor < 110*time.Second || restingFor > 120*time.Second {
+		t.Errorf("Fail: expected the mirror to rest ~120s, got %s", restingFor)
+	}
+}
+
+func TestQueryOverpassRemark(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"elements":[],"remark":"runtime error: Query timed out in \"query\" at line 3 after 25 seconds."}`))
+	}))
+	defer ts.Close()
+
+	if _, err := queryOverpass("[out:json];", ts.URL); err == nil {
+		t.Errorf("Fail: expected an error for a runtime error remark")
+	}
+
+	// The query is at fault, not the endpoint, so it doesn't rest
+	if !overpassRestingUntil(ts.URL).IsZero() {
+		t.Errorf("Fail: expected the endpoint not to rest over a runtime error")
+	}
+}
+
+func TestQueryOverpassAllResting(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	// The only endpoint fails and rests
+	if _, err := queryOverpass("[out:json];", ts.URL); err == nil {
+		t.Fatalf("Fail: expected an error from the failing endpoint")
+	}
+
+	// The next request fails straight away instead of waiting for it
+	start := time.Now()
+	if _, err := queryOverpass("[out:json];", ts.URL); err == nil {
+		t.Errorf("Fail: expected an error while the endpoint rests")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || calls != 1 {
+		t.Errorf("Fail: expected to fail fast without calling the resting endpoint, took %s with %d calls", elapsed, calls)
+	}
+}
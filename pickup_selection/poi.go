@@ -0,0 +1,215 @@
+package main
+
+import "fmt"
+
+// Constant for how close a meeting-point POI must be to name a pickup over other places (in mi, ~160ft)
+const POI_MEETING_TOLERANCE float64 = 0.03
+
+// Constant for how close a named POI must be to label a pickup (in mi, ~320ft)
+const POI_LABEL_TOLERANCE float64 = 0.06
+
+// Constant for how close an address must be to describe a pickup (in mi, ~500ft)
+const POI_ADDRESS_TOLERANCE float64 = 0.1
+
+// A named place near a pickup point (taxi stand, bus stop, entrance, shop, or address)
+type PointOfInterest struct {
+	Location Location
+	Name     string
+	Kind     string
+	Address  string
+}
+
+// A human-readable description of a pickup point
+type PickupLabel struct {
+	Name    string
+	Address string
+}
+
+// Kinds of POI that are meeting points at the curb, so pickups next to them are named after them
+var POI_MEETING_KINDS []string = []string{"taxi", "bus_stop"}
+
+// Helper function to decide what kind of POI an OSM element is
+func poiKind(tags map[string]string) string {
+	switch {
+	case tags["amenity"] == "taxi":
+		return "taxi"
+	case tags["highway"] == "bus_stop":
+		return "bus_stop"
+	case tags["entrance"] != "":
+		return "entrance"
+	case tags["shop"] != "":
+		return "shop"
+	default:
+		return "address"
+	}
+}
+
+// Helper function to build a street address from addr:* tags (empty if incomplete)
+func formatAddress(tags map[string]string) string {
+	if tags["addr:street"] == "" {
+		return ""
+	}
+	if tags["addr:housenumber"] == "" {
+		return tags["addr:street"]
+	}
+	return tags["addr:housenumber"] + " " + tags["addr:street"]
+}
+
+// Somewhere to get points of interest from (Overpass, or a local OSM extract)
+type POISource interface {
+	// Get the points of interest in a radius x radius (mi) box centered at center
+	GetPointsOfInterest(radius float64, center Location) ([]PointOfInterest, error)
+}
+
+// POI source backed by the live Overpass API
+type OverpassPOISource struct {
+	// Overpass URL override for testing ("nil" to use overpass-api.de)
+	APIURL string
+}
+
+// Function to get points of interest from the Overpass API
+func (source OverpassPOISource) GetPointsOfInterest(radius float64, center Location) ([]PointOfInterest, error) {
+	return getPointsOfInterest(radius, center, source.APIURL)
+}
+
+// The POI source used by HandleRequest, chosen once at cold start
+var poiSource POISource = OverpassPOISource{APIURL: "nil"}
+
+// Helper function to check if an OSM element is a point of interest, matching the Overpass query in
+// getPointsOfInterest (bus stops and named entrances are only mapped as nodes)
+func isPointOfInterest(tags map[string]string, node bool) bool {
+	if tags["amenity"] == "taxi" || (tags["shop"] != "" && tags["name"] != "") || (tags["addr:housenumber"] != "" && tags["addr:street"] != "") {
+		return true
+	}
+	return node && (tags["highway"] == "bus_stop" || (tags["entrance"] != "" && tags["name"] != ""))
+}
+
+// Helper function to build a PointOfInterest from an OSM element's position and tags
+func newPointOfInterest(location Location, tags map[string]string) PointOfInterest {
+	return PointOfInterest{
+		Location: location,
+		Name:     tags["name"],
+		Kind:     poiKind(tags),
+		Address:  formatAddress(tags),
+	}
+}
+
+// Get named points of interest and addresses via Overpass API and OpenStreetMap
+func getPointsOfInterest(radius float64, center Location, test_APIURL string) ([]PointOfInterest, error) {
+	// Get bounding box (in two halves across the antimeridian)
+	left, bottom, right, top := getUserBoundingBox(radius, center)
+
+	// Query OSM for meeting points, named places and addresses within the bounding box
+	// (taxi ranks are also how designated rideshare pickup zones are mapped)
+	statements := ""
+	for _, box := range splitAtAntimeridian(left, bottom, right, top) {
+		bbox := fmt.Sprintf("%f,%f,%f,%f", box[1], box[0], box[3], box[2])
+		statements += fmt.Sprintf(`
+			nwr["amenity"="taxi"](%s);
+			node["highway"="bus_stop"](%s);
+			node["entrance"]["name"](%s);
+			nwr["shop"]["name"](%s);
+			nwr["addr:housenumber"]["addr:street"](%s);`,
+			bbox, bbox, bbox, bbox, bbox)
+	}
+	query := fmt.Sprintf(`
+		[out:json];
+		(%s
+		);
+		out center;`,
+		statements)
+
+	// Make the request
+	v, err := queryOverpass(query, test_APIURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unpack each element
+	// Nodes have lat/lon, ways and relations have center.lat/center.lon
+	var pois []PointOfInterest
+	for _, element := range v.GetArray("elements") {
+		position := element
+		if element.Exists("center") {
+			position = element.Get("center")
+		}
+
+		pois = append(pois, newPointOfInterest(Location{
+			Latitude:  position.GetFloat64("lat"),
+			Longitude: position.GetFloat64("lon"),
+		}, parseOverpassTags(element)))
+	}
+
+	return pois, nil
+}
+
+// Helper function to turn a POI into display text
+func poiDisplayName(poi PointOfInterest) string {
+	if poi.Name != "" {
+		return poi.Name
+	}
+
+	// Unnamed meeting points still make good labels
+	switch poi.Kind {
+	case "taxi":
+		return "Taxi stand"
+	case "bus_stop":
+		return "Bus stop"
+	}
+	return ""
+}
+
+// Label each pickup point with the nearest named spot and address.
+// Pickups within POI_MEETING_TOLERANCE of a meeting point (taxi stand, bus stop) are named after it.
+// Pickups are never moved, as they've already been snapped to legal curbside spots and deduped.
+func labelPickupPoints(pickups []Location, pois []PointOfInterest) []PickupLabel {
+	labels := make([]PickupLabel, len(pickups))
+
+	for i, pickup := range pickups {
+		// Step 1. Find the closest meeting point, named place, and address
+		bestMeeting, bestNamed, bestAddress := -1, -1, -1
+		meetingDistance := POI_MEETING_TOLERANCE
+		namedDistance := POI_LABEL_TOLERANCE
+		addressDistance := POI_ADDRESS_TOLERANCE
+		for j, poi := range pois {
+			distance := distanceMiles(pickup, poi.Location)
+
+			isMeeting := false
+			for _, kind := range POI_MEETING_KINDS {
+				if poi.Kind == kind {
+					isMeeting = true
+				}
+			}
+
+			if isMeeting && distance <= meetingDistance {
+				bestMeeting, meetingDistance = j, distance
+			}
+			if poiDisplayName(poi) != "" && distance <= namedDistance {
+				bestNamed, namedDistance = j, distance
+			}
+			if poi.Address != "" && distance <= addressDistance {
+				bestAddress, addressDistance = j, distance
+			}
+		}
+
+		// Step 2. Prefer a meeting point for the name
+		if bestMeeting >= 0 {
+			bestNamed = bestMeeting
+		}
+
+		// Step 3. Attach the label
+		if bestNamed >= 0 {
+			labels[i].Name = poiDisplayName(pois[bestNamed])
+		}
+		if bestAddress >= 0 {
+			labels[i].Address = pois[bestAddress].Address
+		}
+
+		// Step 4. Fall back to the address for the name
+		if labels[i].Name == "" {
+			labels[i].Name = labels[i].Address
+		}
+	}
+
+	return labels
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetPointsOfInterest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"elements":[{"type":"node","lat":30.6161,"lon":-96.3371,"tags":{"amenity":"taxi"}},{"type":"way","center":{"lat":30.6165,"lon":-96.3375},"tags":{"shop":"coffee","name":"Sweet Eugene's","addr:housenumber":"1702","addr:street":"George Bush Drive"}}]}`))
+	}))
+	defer ts.Close()
+
+	pois, err := getPointsOfInterest(1, Location{Latitude: 30.616, Longitude: -96.337}, ts.URL)
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(pois) != 2 {
+		t.Fatalf("Fail: expected 2 POIs, got %d", len(pois))
+	}
+	if pois[0].Kind != "taxi" {
+		t.Errorf("Fail: expected taxi, got %s", pois[0].Kind)
+	}
+	if pois[1].Location.Latitude != 30.6165 || pois[1].Address != "1702 George Bush Drive" {
+		t.Errorf("Fail: way POI was not unpacked correctly, got %+v", pois[1])
+	}
+}
+
+func TestLabelPickupPoints(t *testing.T) {
+	pickup := Location{Latitude: 30.6, Longitude: -96.3}
+	taxi := Location{Latitude: 30.6 + milesToDegLatitude(0.01, 30.6), Longitude: -96.3}
+	shop := Location{Latitude: 30.6, Longitude: -96.3 + milesToDegLongitude(0.04, 30.6)}
+	pois := []PointOfInterest{
+		{Location: shop, Name: "Corner Store", Kind: "shop", Address: "100 Main St"},
+		{Location: taxi, Kind: "taxi"},
+	}
+
+	// Close to the taxi stand: named after it, keeps the shop's address
+	labels := labelPickupPoints([]Location{pickup}, pois)
+	if labels[0].Name != "Taxi stand" || labels[0].Address != "100 Main St" {
+		t.Errorf("Fail: unexpected label %+v", labels[0])
+	}
+
+	// Without the taxi stand: labeled by the shop
+	labels = labelPickupPoints([]Location{pickup}, pois[:1])
+	if labels[0].Name != "Corner Store" {
+		t.Errorf("Fail: unexpected label %+v", labels[0])
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/valyala/fastjson"
 )
@@ -15,15 +19,25 @@ import (
 type Ride struct {
 	Source        Location `json:"source"`
 	PickupPoint   Location `json:"pickupPoint"`
+	PickupName    string   `json:"pickupName,omitempty"`
+	PickupAddress string   `json:"pickupAddress,omitempty"`
+	PickupStreet  string   `json:"pickupStreet,omitempty"`
+	PickupHeading float64  `json:"pickupHeading"`
+	PickupSide    string   `json:"pickupSide,omitempty"`
 	Destination   Location `json:"destination"`
-	WalkTime      float64  `json:"walkTime"`
-	WalkDistance  float64  `json:"walkDistance"`
-	DriveTime     float64  `json:"driveTime"`
-	DriveDistance float64  `json:"driveDistance"`
-	TotalTime     float64  `json:"totalTime"`
-	TotalDistance float64  `json:"totalDistance"`
-	Price         float64  `json:"price"`
-	Savings       float64  `json:"savings"`
+	// Set when the rider also walks from a drop-off point to the destination
+	DropoffPoint        *Location `json:"dropoffPoint,omitempty"`
+	DropoffStreet       string    `json:"dropoffStreet,omitempty"`
+	DropoffWalkTime     float64   `json:"dropoffWalkTime,omitempty"`
+	DropoffWalkDistance float64   `json:"dropoffWalkDistance,omitempty"`
+	WalkTime            float64   `json:"walkTime"`
+	WalkDistance        float64   `json:"walkDistance"`
+	DriveTime           float64   `json:"driveTime"`
+	DriveDistance       float64   `json:"driveDistance"`
+	TotalTime           float64   `json:"totalTime"`
+	TotalDistance       float64   `json:"totalDistance"`
+	Price               float64   `json:"price"`
+	Savings             float64   `json:"savings"`
 }
 
 // This stores all the data needed to price a ride
@@ -63,20 +77,54 @@ func BuildRides(inbounds []RouteSummary, outbounds []RouteSummary) []Ride {
 	return rides
 }
 
+// Builds the MLPricingData for each driving route, as of now
+func BuildPricingData(routes []Route) []MLPricingData {
+	// Get the day-of-week and time-of-day
+	// TODO: in future we would want the user's time zone...
+	// assume CDT for now
+	loc := time.FixedZone("CDT", -5*60*60)
+	now := time.Now().In(loc)
+	day_of_week := float64(now.Weekday()) / 7
+	time_of_day := (float64(now.Hour()) + (float64(now.Minute()) / 60)) / 24
+
+	// Now build pricing data
+	pricingData := make([]MLPricingData, len(routes))
+	for i, route := range routes {
+		data := MLPricingData{
+			TimeInSeconds:        float64(route.TravelTimeInSeconds),
+			DistanceInMeters:     float64(route.LengthInMeters),
+			TimeToHistoricRatio:  float64(route.TravelTimeInSeconds) / float64(route.HistoricalTrafficTravelTimeInSeconds),
+			TimeToNoTrafficRatio: float64(route.TravelTimeInSeconds) / float64(route.NoTrafficTravelTimeInSeconds),
+			DayOfWeekSin:         math.Sin(2 * math.Pi * day_of_week),
+			DayOfWeekCos:         math.Cos(2 * math.Pi * day_of_week),
+			TimeOfDaySin:         math.Sin(2 * math.Pi * time_of_day),
+			TimeOfDayCos:         math.Cos(2 * math.Pi * time_of_day),
+		}
+
+		pricingData[i] = data
+	}
+	return pricingData
+}
+
+// Helper function to format one ride's pricing data as a JSON row
+func pricingRowJSON(data MLPricingData) string {
+	return fmt.Sprintf("[%f,%f,%f,%f,%f,%f,%f,%f]",
+		data.TimeInSeconds,
+		data.DistanceInMeters,
+		data.TimeToHistoricRatio,
+		data.TimeToNoTrafficRatio,
+		data.DayOfWeekSin,
+		data.DayOfWeekCos,
+		data.TimeOfDaySin,
+		data.TimeOfDayCos)
+}
+
 // Helper function to construct JSON text for use with pricing endpoint
 func BuildPricingJSON(pricingData []MLPricingData) string {
 	// Now simply exporting { data: [][8]float32 }
 	out := `{ "data": [`
 	for i, data := range pricingData {
-		out += fmt.Sprintf("[%f,%f,%f,%f,%f,%f,%f,%f]",
-			data.TimeInSeconds,
-			data.DistanceInMeters,
-			data.TimeToHistoricRatio,
-			data.TimeToNoTrafficRatio,
-			data.DayOfWeekSin,
-			data.DayOfWeekCos,
-			data.TimeOfDaySin,
-			data.TimeOfDayCos)
+		out += pricingRowJSON(data)
 		if i != len(pricingData)-1 {
 			out += ","
 		}
@@ -84,52 +132,140 @@ func BuildPricingJSON(pricingData []MLPricingData) string {
 	return out + "]}"
 }
 
-// Adds price information to a list of Rides using MLPricingData and the pricing endpoint
-func PriceRides(rides []Ride, pricingData []MLPricingData) []Ride {
+// Helper function to get the cache key of a price (a hash of the features the model sees)
+func priceCacheKey(data MLPricingData) string {
+	hash := fnv.New64a()
+	io.WriteString(hash, pricingRowJSON(data))
+	return fmt.Sprintf("price_%x", hash.Sum64())
+}
+
+// Adds price information to a list of Rides using MLPricingData and the pricing endpoint, going through cache first.
+// Prices are cached by their features for a short time (PRICE_TTL), as the time of day is one of them.
+// pricingData[i] must be the pricing row of rides[i], and the last ride is the no-walking ride that
+// savings are measured against.
+func PriceRides(cache RouteCache, rides []Ride, pricingData []MLPricingData) ([]Ride, error) {
+	// Every ride needs its pricing row
+	if len(pricingData) != len(rides) {
+		return nil, fmt.Errorf("got %d pricing rows for %d rides", len(pricingData), len(rides))
+	}
+
+	// Nothing to price
+	if len(rides) == 0 {
+		return rides, nil
+	}
+
+	// Get ttl setting
+	ttl, err := strconv.Atoi(os.Getenv("PRICE_TTL"))
+	if err != nil {
+		// Default to 1min ttl
+		ttl = 60
+	}
+
+	// Step 1. Pull every price from cache at once
+	keys := make([]string, len(pricingData))
+	for i, data := range pricingData {
+		keys[i] = priceCacheKey(data)
+	}
+	span := startSpan("cache.get")
+	span.SetAttr("prefix", "price")
+	values := cache.GetMulti(keys)
+	span.End()
+
+	var missed []MLPricingData
+	var missedRides []int
+	for i := range pricingData {
+		price, err := strconv.ParseFloat(values[keys[i]], 64)
+		if err != nil {
+			missed = append(missed, pricingData[i])
+			missedRides = append(missedRides, i)
+			continue
+		}
+		rides[i].Price = price
+	}
+	recordCacheLookups("price", len(pricingData)-len(missed), len(missed))
+
+	// Step 2. Price the rest with the pricing endpoint
+	if len(missed) > 0 {
+		prices, err := requestPrices(missed)
+		if err != nil {
+			return nil, err
+		}
+		if len(prices) != len(missed) {
+			return nil, fmt.Errorf("pricing endpoint returned %d prices for %d rows", len(prices), len(missed))
+		}
+
+		// Prices come back in the order the rows were sent
+		newPrices := make(map[string]string)
+		for k, price := range prices {
+			i := missedRides[k]
+			rides[i].Price = price
+			newPrices[keys[i]] = strconv.FormatFloat(price, 'f', -1, 64)
+		}
+
+		// Store the new prices in cache in the background
+		pendingCacheWrites.Add(1)
+		go func() {
+			defer pendingCacheWrites.Done()
+			cache.SetMulti(newPrices, int32(ttl))
+		}()
+	}
+
+	// Step 3. Work out the savings against the no-walking ride
+	noWalkPrice := rides[len(rides)-1].Price
+	for i := range rides {
+		rides[i].Savings = 100 * (noWalkPrice - rides[i].Price) / noWalkPrice
+		stageLog("pricing").Debug("priced ride", "price", rides[i].Price, "noWalkPrice", noWalkPrice, "savings", rides[i].Savings)
+	}
+
+	return rides, nil
+}
+
+// Helper function to get prices from the pricing endpoint, in the order of pricingData
+func requestPrices(pricingData []MLPricingData) ([]float64, error) {
 	// Build request body
 	requestBody := BuildPricingJSON(pricingData)
 
-	// Print request
-	print(requestBody)
-
 	// Make HTTP request to pricing service
 	url := os.Getenv("PRICING_API_URL")
 
-	fmt.Printf("Making request to %s\n", url)
-	fmt.Printf("Request body: %s\n", requestBody)
+	stageLog("pricing").Info("requesting prices", "url", url, "rows", len(pricingData))
+	stageLog("pricing").Debug("pricing request", "body", requestBody)
+	span := startSpan("pricing.request")
+	span.SetAttr("rows", strconv.Itoa(len(pricingData)))
+	defer span.End()
 	req, err := http.Post(url, "application/json", strings.NewReader(requestBody))
+	recordUpstream("pricing", req, err)
 	if err != nil {
-		fmt.Printf("Error making http request: %s", err)
-		os.Exit(1)
+		span.SetError(err)
+		return nil, fmt.Errorf("making http request: %w", err)
 	}
+	defer req.Body.Close()
 
 	// Decode the response
 	resBody, err := io.ReadAll(req.Body)
 	if err != nil {
-		fmt.Printf("Error reading response body: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("reading pricing response: %w", err)
+	}
+	stageLog("pricing").Debug("pricing response", "status", req.StatusCode, "body", string(resBody))
+	if req.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pricing endpoint returned status %d", req.StatusCode)
 	}
-	fmt.Printf("Response body: %s\n", string(resBody))
 
 	// Parse the response
 	var p fastjson.Parser
 	v, err := p.Parse(string(resBody))
 	if err != nil {
-		fmt.Printf("Error parsing response body: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("parsing pricing response: %w", err)
 	}
 
-	// Get the prices
-	prices := v.GetArray("prices")
-	noWalkPrice := prices[len(prices)-1].GetFloat64()
-
-	for i, price := range prices {
-		rides[i].Price = price.GetFloat64()
-		fmt.Printf("Price: %f\n", rides[i].Price)
-		fmt.Printf("No walk price: %f\n", noWalkPrice)
-		rides[i].Savings = 100 * (noWalkPrice - rides[i].Price) / noWalkPrice
-		fmt.Printf("Savings: %f\n", rides[i].Savings)
+	// Get the prices (every one must be a number)
+	var prices []float64
+	for i, price := range v.GetArray("prices") {
+		value, err := price.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("pricing endpoint returned a bad price at row %d: %w", i, err)
+		}
+		prices = append(prices, value)
 	}
-
-	return rides
+	return prices, nil
 }
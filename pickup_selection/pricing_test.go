@@ -63,8 +63,76 @@ func TestPriceRides(t *testing.T) {
 		{Source: Location{Latitude: 30.5324314241, Longitude: 92.3523423345}, PickupPoint: Location{Latitude: 30.6324314241, Longitude: 92.2523423345}, Destination: Location{Latitude: 30.3324314241, Longitude: 92.5523423345}, WalkTime: 21.41, WalkDistance: 6.23, DriveTime: 15.43, DriveDistance: 6.43, TotalTime: 32.32, TotalDistance: 5.325, Price: 0.0},
 	}
 
-	ride := PriceRides(test_rides, []MLPricingData{})
-	if ride[0].Price == 0 {
-		t.Errorf("Fail: Price model did not return a value")
+	test_pricing := []MLPricingData{{TimeInSeconds: 745}, {TimeInSeconds: 685}, {TimeInSeconds: 925}}
+
+	ride, err := PriceRides(NewLRUCache(10), test_rides, test_pricing)
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if ride[0].Price != 9.482263565063477 || ride[2].Price != 13.169022560119629 {
+		t.Errorf("Fail: expected each ride to get its own price, got %+v", ride)
+	}
+
+	// Every ride needs a pricing row
+	if _, err := PriceRides(NewLRUCache(10), test_rides, test_pricing[:2]); err == nil {
+		t.Errorf("Fail: expected an error pricing 3 rides with 2 rows")
+	}
+}
+
+func TestPriceRidesCache(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(200)
+		w.Write([]byte(`{"prices": [8, 10]}`))
+	}))
+	defer ts.Close()
+	t.Setenv("PRICING_API_URL", ts.URL)
+
+	cache := NewLRUCache(10)
+	pricingData := []MLPricingData{{TimeInSeconds: 300}, {TimeInSeconds: 400}}
+
+	// First time asks the endpoint, second time is all from cache
+	for attempt := 0; attempt < 2; attempt++ {
+		rides, err := PriceRides(cache, []Ride{{}, {}}, pricingData)
+		if err != nil {
+			t.Fatalf("Fail: unexpected error %s", err)
+		}
+		FlushCacheWrites()
+		if rides[0].Price != 8 || rides[1].Price != 10 || rides[0].Savings != 20 {
+			t.Errorf("Fail: unexpected prices %+v", rides)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Fail: expected 1 pricing request, got %d", requests)
+	}
+}
+
+func TestPriceRidesErrors(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusInternalServerError, `{"prices": [8, 10]}`},
+		{http.StatusOK, `not json`},
+		{http.StatusOK, `{"prices": [8, "ten"]}`},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		t.Setenv("PRICING_API_URL", ts.URL)
+
+		// A bad response is an error for the request, not the end of the container
+		if _, err := PriceRides(NewLRUCache(10), []Ride{{}, {}}, []MLPricingData{{TimeInSeconds: 300}, {TimeInSeconds: 400}}); err == nil {
+			t.Errorf("Fail: expected an error for %d %s", test.status, test.body)
+		}
+		ts.Close()
+	}
+
+	// So is an endpoint that can't be reached
+	t.Setenv("PRICING_API_URL", "http://127.0.0.1:1")
+	if _, err := PriceRides(NewLRUCache(10), []Ride{{}}, []MLPricingData{{TimeInSeconds: 300}}); err == nil {
+		t.Errorf("Fail: expected an error when the endpoint is down")
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for the default daily quotas (billable units per UTC day) of the routing APIs.
+// TomTom bills every batch item and matrix cell, ORS counts every matrix request.
+const TOMTOM_DEFAULT_DAILY_QUOTA int64 = 2500
+const ORS_DEFAULT_DAILY_QUOTA int64 = 500
+
+// Constants for the default share of a quota past which fewer pickups are routed (soft), and past which
+// only cached routes are served (hard)
+const QUOTA_DEFAULT_SOFT_LIMIT float64 = 0.8
+const QUOTA_DEFAULT_HARD_LIMIT float64 = 0.95
+
+// Constant for the default most pickups routed once past a soft limit
+const QUOTA_DEFAULT_SOFT_MAX_POINTS int = 4
+
+// Constant for how long daily counters are kept in cache (in sec, a day plus slack for stats)
+const QUOTA_COUNTER_TTL int32 = 60 * 60 * 48
+
+// Providers whose calls count against a quota
+var QUOTA_PROVIDERS []string = []string{"tomtom", "ors"}
+
+// How much of one provider's daily quota has been used
+type ProviderUsage struct {
+	Provider string `json:"provider"`
+	Day      string `json:"day"`
+	Used     int64  `json:"used"`
+	Quota    int64  `json:"quota"`
+	// "normal", "soft" (fewer pickups are routed) or "hard" (only cached routes are served)
+	Mode string `json:"mode"`
+}
+
+// Usage at the start of the request being handled, by provider.
+// Lambda hands a container one request at a time, so one set is enough.
+var requestUsage = struct {
+	mutex sync.RWMutex
+	usage map[string]ProviderUsage
+}{usage: make(map[string]ProviderUsage)}
+
+// Helper function to get the UTC day quotas are counted in
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// Helper function to get the cache key of a provider's counter for a day
+func quotaKey(provider string, day string) string {
+	return fmt.Sprintf("quota_%s_%s", provider, day)
+}
+
+// Helper function to get a provider's daily quota from <PROVIDER>_DAILY_QUOTA, or the default (0 is unlimited)
+func dailyQuota(provider string) int64 {
+	defaults := map[string]int64{"tomtom": TOMTOM_DEFAULT_DAILY_QUOTA, "ors": ORS_DEFAULT_DAILY_QUOTA}
+	quota, err := strconv.ParseInt(os.Getenv(fmt.Sprintf("%s_DAILY_QUOTA", strings.ToUpper(provider))), 10, 64)
+	if err != nil || quota < 0 {
+		return defaults[provider]
+	}
+	return quota
+}
+
+// Helper function to get a share of a quota from the environment, or the default
+func quotaLimit(name string, fallback float64) float64 {
+	limit, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || limit <= 0 {
+		return fallback
+	}
+	return limit
+}
+
+// Helper function to get the most pickups routed past a soft limit, from QUOTA_SOFT_MAX_POINTS or the default
+func softMaxPoints() int {
+	points, err := strconv.Atoi(os.Getenv("QUOTA_SOFT_MAX_POINTS"))
+	if err != nil || points <= 0 {
+		return QUOTA_DEFAULT_SOFT_MAX_POINTS
+	}
+	return points
+}
+
+// Helper function to work out the budget mode for some usage of a quota
+func quotaMode(used int64, quota int64) string {
+	if quota == 0 {
+		return "normal"
+	}
+	share := float64(used) / float64(quota)
+	switch {
+	case share >= quotaLimit("QUOTA_HARD_LIMIT", QUOTA_DEFAULT_HARD_LIMIT):
+		return "hard"
+	case share >= quotaLimit("QUOTA_SOFT_LIMIT", QUOTA_DEFAULT_SOFT_LIMIT):
+		return "soft"
+	default:
+		return "normal"
+	}
+}
+
+// Function to count billable units of a provider against today's quota, in the background.
+// Use FlushCacheWrites to wait for it.
+func recordBillable(cache RouteCache, provider string, units int) {
+	if units <= 0 {
+		return
+	}
+	recordCount("pickup.upstream.billable", int64(units), map[string]string{"provider": provider})
+
+	key := quotaKey(provider, quotaDay(time.Now()))
+	pendingCacheWrites.Add(1)
+	go func() {
+		defer pendingCacheWrites.Done()
+		cache.Incr(key, int64(units), QUOTA_COUNTER_TTL)
+	}()
+}
+
+// Function to get today's usage of every provider's quota
+func GetUsage(cache RouteCache) []ProviderUsage {
+	day := quotaDay(time.Now())
+	keys := make([]string, len(QUOTA_PROVIDERS))
+	for i, provider := range QUOTA_PROVIDERS {
+		keys[i] = quotaKey(provider, day)
+	}
+	values := cache.GetMulti(keys)
+
+	usage := make([]ProviderUsage, len(QUOTA_PROVIDERS))
+	for i, provider := range QUOTA_PROVIDERS {
+		used, _ := strconv.ParseInt(values[keys[i]], 10, 64)
+		quota := dailyQuota(provider)
+		usage[i] = ProviderUsage{Provider: provider, Day: day, Used: used, Quota: quota, Mode: quotaMode(used, quota)}
+	}
+	return usage
+}
+
+// Function to look up today's usage once at the start of a request, so every stage agrees on the budget mode
+func startRequestBudget(cache RouteCache) []ProviderUsage {
+	usage := GetUsage(cache)
+
+	requestUsage.mutex.Lock()
+	defer requestUsage.mutex.Unlock()
+	requestUsage.usage = make(map[string]ProviderUsage)
+	for _, providerUsage := range usage {
+		requestUsage.usage[providerUsage.Provider] = providerUsage
+		if providerUsage.Mode != "normal" {
+			stageLog("quota").Warn("quota budget reached", "provider", providerUsage.Provider, "used", providerUsage.Used, "quota", providerUsage.Quota, "mode", providerUsage.Mode)
+		}
+	}
+	return usage
+}
+
+// Function to get a provider's budget mode for the request being handled
+func budgetMode(provider string) string {
+	requestUsage.mutex.RLock()
+	defer requestUsage.mutex.RUnlock()
+	if usage, ok := requestUsage.usage[provider]; ok {
+		return usage.Mode
+	}
+	return "normal"
+}
+
+// Function to check whether any provider is past a given budget mode ("soft" includes "hard")
+func anyBudgetAt(mode string) bool {
+	for _, provider := range QUOTA_PROVIDERS {
+		current := budgetMode(provider)
+		if current == mode || (mode == "soft" && current == "hard") {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to find which pickups can be served without billable calls, past a hard limit.
+// A pickup needs its walk cached if ORS is past its hard limit, and its drive cached if TomTom is.
+// headings[i] is the car's heading at pickups[i] (or -1 if unknown).
+func cachedOnlyPickups(cache RouteCache, source Location, destination Location, pickups []Location, headings []float64) []bool {
+	keep := make([]bool, len(pickups))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	// Check every walk (pickup -> source) and drive (pickup -> destination) needed at once
+	check := func(prefix string, headings []float64, to Location) {
+		targets := make([]Location, len(pickups))
+		for i := range targets {
+			targets[i] = to
+		}
+		_, missed, _ := GetRoutes(cache, prefix, pickups, headings, targets)
+		for _, i := range missed {
+			keep[i] = false
+		}
+	}
+	if budgetMode("ors") == "hard" {
+		check("ors", nil, source)
+	}
+	if budgetMode("tomtom") == "hard" {
+		check("tt", headings, destination)
+	}
+	return keep
+}
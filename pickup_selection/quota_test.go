@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaMode(t *testing.T) {
+	t.Setenv("QUOTA_SOFT_LIMIT", "")
+	t.Setenv("QUOTA_HARD_LIMIT", "")
+	if mode := quotaMode(100, 1000); mode != "normal" {
+		t.Errorf("Fail: expected normal at 10%%, got %s", mode)
+	}
+	if mode := quotaMode(800, 1000); mode != "soft" {
+		t.Errorf("Fail: expected soft at 80%%, got %s", mode)
+	}
+	if mode := quotaMode(950, 1000); mode != "hard" {
+		t.Errorf("Fail: expected hard at 95%%, got %s", mode)
+	}
+	if mode := quotaMode(1e9, 0); mode != "normal" {
+		t.Errorf("Fail: expected no quota to be unlimited, got %s", mode)
+	}
+
+	t.Setenv("QUOTA_SOFT_LIMIT", "0.5")
+	if mode := quotaMode(500, 1000); mode != "soft" {
+		t.Errorf("Fail: expected soft at 50%% with QUOTA_SOFT_LIMIT=0.5, got %s", mode)
+	}
+}
+
+func TestRecordBillable(t *testing.T) {
+	t.Setenv("TOMTOM_DAILY_QUOTA", "10")
+	t.Setenv("ORS_DAILY_QUOTA", "")
+	cache := NewLRUCache(10)
+	t.Cleanup(func() { startRequestBudget(NewLRUCache(10)) })
+
+	recordBillable(cache, "tomtom", 5)
+	recordBillable(cache, "tomtom", 3)
+	recordBillable(cache, "ors", 1)
+	FlushCacheWrites()
+
+	usage := startRequestBudget(cache)
+	if len(usage) != 2 || usage[0].Provider != "tomtom" || usage[0].Used != 8 || usage[0].Quota != 10 || usage[0].Mode != "soft" {
+		t.Errorf("Fail: expected tomtom at 8/10 (soft), got %+v", usage)
+	}
+	if usage[1].Used != 1 || usage[1].Quota != ORS_DEFAULT_DAILY_QUOTA || usage[1].Mode != "normal" {
+		t.Errorf("Fail: expected ors at 1/%d, got %+v", ORS_DEFAULT_DAILY_QUOTA, usage[1])
+	}
+	if usage[0].Day != time.Now().UTC().Format("2006-01-02") {
+		t.Errorf("Fail: expected today's window, got %s", usage[0].Day)
+	}
+
+	// Every stage of the request agrees on the modes
+	if budgetMode("tomtom") != "soft" || !anyBudgetAt("soft") || anyBudgetAt("hard") {
+		t.Errorf("Fail: expected only a soft budget, got tomtom %s", budgetMode("tomtom"))
+	}
+}
+
+func TestCachedOnlyPickups(t *testing.T) {
+	t.Setenv("TOMTOM_DAILY_QUOTA", "10")
+	t.Setenv("ORS_DAILY_QUOTA", "0")
+	cache := NewLRUCache(10)
+	t.Cleanup(func() { startRequestBudget(NewLRUCache(10)) })
+
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	cachedPickup := Location{Latitude: 30.601, Longitude: -96.3}
+	uncachedPickup := Location{Latitude: 30.61, Longitude: -96.3}
+	StoreRoute(cache, "tt", Route{TravelTimeInSeconds: 300, Source: cachedPickup, Destination: destination}, 60)
+
+	// Nothing is dropped before the hard limit
+	startRequestBudget(cache)
+	if keep := cachedOnlyPickups(cache, source, destination, []Location{cachedPickup, uncachedPickup}, []float64{-1, -1}); !keep[0] || !keep[1] {
+		t.Errorf("Fail: expected every pickup kept under budget, got %v", keep)
+	}
+
+	// Past TomTom's hard limit only cached drives are kept (ORS is unlimited, so walks aren't checked)
+	cache.Set(quotaKey("tomtom", quotaDay(time.Now())), "10", 60)
+	startRequestBudget(cache)
+	if keep := cachedOnlyPickups(cache, source, destination, []Location{cachedPickup, uncachedPickup}, []float64{-1, -1}); !keep[0] || keep[1] {
+		t.Errorf("Fail: expected only the cached pickup kept, got %v", keep)
+	}
+}
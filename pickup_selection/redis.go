@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constant for how long to wait on Redis before giving up (a cache miss is cheaper than a slow cache)
+const REDIS_TIMEOUT time.Duration = 2 * time.Second
+
+// Redis cache, speaking just enough of the Redis protocol (RESP) for GET, MGET, SET, SET NX, INCRBY and MULTI/EXEC over one connection
+type RedisCache struct {
+	address  string
+	password string
+	database int
+	useTLS   bool
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Function to get a new RedisCache from a URL like redis://:password@host:6379/0 (or rediss:// for TLS).
+// A bare host:port also works. Connects lazily on first use.
+func NewRedisCache(redisURL string) (*RedisCache, error) {
+	if !strings.Contains(redisURL, "://") {
+		redisURL = "redis://" + redisURL
+	}
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+	}
+
+	cache := &RedisCache{address: u.Host, useTLS: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		cache.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	// Password is either redis://:password@ or redis://password@
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			cache.password = password
+		} else {
+			cache.password = u.User.Username()
+		}
+	}
+
+	// Database number is the path
+	if database := strings.TrimPrefix(u.Path, "/"); database != "" {
+		cache.database, err = strconv.Atoi(database)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", database)
+		}
+	}
+
+	return cache, nil
+}
+
+// Helper function to connect (and log in) if not connected already
+func (cache *RedisCache) connect() error {
+	if cache.conn != nil {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: REDIS_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if cache.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cache.address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", cache.address)
+	}
+	if err != nil {
+		return err
+	}
+	cache.conn = conn
+	cache.reader = bufio.NewReader(conn)
+
+	// Log in and pick the database
+	if cache.password != "" {
+		if _, err := cache.command("AUTH", cache.password); err != nil {
+			cache.close()
+			return err
+		}
+	}
+	if cache.database != 0 {
+		if _, err := cache.command("SELECT", strconv.Itoa(cache.database)); err != nil {
+			cache.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper function to drop the connection (so the next command reconnects)
+func (cache *RedisCache) close() {
+	if cache.conn != nil {
+		cache.conn.Close()
+	}
+	cache.conn = nil
+	cache.reader = nil
+}
+
+// Helper function to send one command and read its reply on the open connection
+func (cache *RedisCache) command(args ...string) (interface{}, error) {
+	cache.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+
+	if _, err := io.WriteString(cache.conn, encodeRESPCommand(args)); err != nil {
+		return nil, err
+	}
+	return readRESPReply(cache.reader)
+}
+
+// Function to run a Redis command, reconnecting if needed
+func (cache *RedisCache) Do(args ...string) (interface{}, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.connect(); err != nil {
+		return nil, err
+	}
+
+	reply, err := cache.command(args...)
+	if err != nil {
+		// Redis errors leave the connection usable, anything else doesn't
+		if _, ok := err.(redisError); !ok {
+			cache.close()
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Function to get a value from Redis (false if not found)
+func (cache *RedisCache) Get(key string) (string, bool) {
+	reply, err := cache.Do("GET", key)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return "", false
+	}
+	value, ok := reply.(string)
+	return value, ok
+}
+
+// Function to store a value in Redis
+func (cache *RedisCache) Set(key string, value string, ttl int32) {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "EX", strconv.Itoa(int(ttl)))
+	}
+	if _, err := cache.Do(args...); err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+	}
+}
+
+// Function to store a value in Redis only if the key isn't there already (SET NX).
+// Errors count as stored, so a broken cache never holds anyone off.
+func (cache *RedisCache) Add(key string, value string, ttl int32) bool {
+	args := []string{"SET", key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "EX", strconv.Itoa(int(ttl)))
+	}
+	reply, err := cache.Do(args...)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return true
+	}
+	return reply != nil
+}
+
+// Function to add to a counter in Redis (INCRBY), keeping it for ttl seconds from when it was created.
+// Creates the counter with its expiry (SET NX EX) and adds to it in one MULTI/EXEC, so the expiry isn't
+// pushed back by every add and the counter never lives on without one.
+func (cache *RedisCache) Incr(key string, delta int64, ttl int32) int64 {
+	if ttl <= 0 {
+		reply, err := cache.Do("INCRBY", key, strconv.FormatInt(delta, 10))
+		if err != nil {
+			stageLog("cache").Warn("cache error", "error", err)
+			return -1
+		}
+		value, _ := reply.(int64)
+		return value
+	}
+
+	replies, err := cache.pipeline([][]string{
+		{"MULTI"},
+		{"SET", key, "0", "NX", "EX", strconv.Itoa(int(ttl))},
+		{"INCRBY", key, strconv.FormatInt(delta, 10)},
+		{"EXEC"},
+	})
+	if err == nil {
+		if execErr, ok := replies[len(replies)-1].(error); ok {
+			err = execErr
+		}
+	}
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return -1
+	}
+
+	// EXEC replies with the reply of each queued command
+	results, _ := replies[len(replies)-1].([]interface{})
+	if len(results) != 2 {
+		stageLog("cache").Warn("cache error", "error", fmt.Errorf("redis: unexpected EXEC reply %v", replies[len(replies)-1]))
+		return -1
+	}
+	for _, result := range results {
+		if err, ok := result.(error); ok {
+			stageLog("cache").Warn("cache error", "error", err)
+			return -1
+		}
+	}
+	value, _ := results[1].(int64)
+	return value
+}
+
+// Function to get many values from Redis with one MGET
+func (cache *RedisCache) GetMulti(keys []string) map[string]string {
+	values := make(map[string]string)
+	if len(keys) == 0 {
+		return values
+	}
+
+	reply, err := cache.Do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return values
+	}
+	items, _ := reply.([]interface{})
+	for i, item := range items {
+		if value, ok := item.(string); ok && i < len(keys) {
+			values[keys[i]] = value
+		}
+	}
+	return values
+}
+
+// Function to store many values in Redis, pipelining the SETs in one round trip
+func (cache *RedisCache) SetMulti(values map[string]string, ttl int32) {
+	if len(values) == 0 {
+		return
+	}
+
+	var commands [][]string
+	for key, value := range values {
+		args := []string{"SET", key, value}
+		if ttl > 0 {
+			args = append(args, "EX", strconv.Itoa(int(ttl)))
+		}
+		commands = append(commands, args)
+	}
+	replies, err := cache.pipeline(commands)
+	if err != nil {
+		stageLog("cache").Warn("cache error", "error", err)
+		return
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(error); ok {
+			stageLog("cache").Warn("cache error", "error", err)
+		}
+	}
+}
+
+// Helper function to send several commands in one write and read every reply, reconnecting if needed.
+// Returns the replies in order, with a redisError for each command Redis refused.
+func (cache *RedisCache) pipeline(commands [][]string) ([]interface{}, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.connect(); err != nil {
+		return nil, err
+	}
+
+	// Write every command, then read every reply
+	var pipeline strings.Builder
+	for _, args := range commands {
+		pipeline.WriteString(encodeRESPCommand(args))
+	}
+	cache.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	if _, err := io.WriteString(cache.conn, pipeline.String()); err != nil {
+		cache.close()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRESPReply(cache.reader)
+		if err != nil {
+			// Redis errors leave the connection usable, anything else doesn't
+			if _, ok := err.(redisError); !ok {
+				cache.close()
+				return nil, err
+			}
+			reply = err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// An error reply from Redis
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// Helper function to encode a command as a RESP array of bulk strings
+func encodeRESPCommand(args []string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&builder, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return builder.String()
+}
+
+// Helper function to read one RESP reply.
+// Returns a string, int64, nil (for null), []interface{} (with a redisError for each element that's an error)
+// or a redisError.
+func readRESPReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		// Read every element, even past an error one, so the next reply starts in the right place
+		items := make([]interface{}, length)
+		for i := range items {
+			item, err := readRESPReply(reader)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
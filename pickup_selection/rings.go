@@ -0,0 +1,120 @@
+package main
+
+import "math"
+
+// Constant for where each ring sits as a fraction of the largest ring (matches the default RING_RADII)
+var RING_FRACTIONS []float64 = []float64{0.15, 0.35, 0.65, 1.0}
+
+// Constant for the smallest and largest outer ring radius (in mi)
+const RING_MIN_RADIUS float64 = 0.1
+const RING_MAX_RADIUS float64 = 1.0
+
+// Constants for sizing the outer ring from trip length: radius = base + perMile * trip (in mi)
+// (a 1mi ride walks at most 0.2mi, a 12mi ride 0.75mi)
+const RING_BASE_RADIUS float64 = 0.15
+const RING_RADIUS_PER_TRIP_MILE float64 = 0.05
+
+// Constant for the extra street margin fetched around the outer ring (in mi), for curbside shifting
+const RING_BOX_MARGIN float64 = 0.1
+
+// Constant for the number of points queried per request, shared between rings (matches the default CULL_SEGMENTS)
+const RING_POINT_BUDGET int = 14
+
+// Constant for the most segments a single ring may be divided into
+const RING_MAX_SEGMENTS int = 6
+
+// How to lay out pickup rings for one request
+type RingPlan struct {
+	Radii    []float64 // in mi
+	Segments []int
+	Amounts  []int
+	BoxSize  float64 // size of the street bounding box (in mi)
+}
+
+// Function to get the fixed ring layout (RING_RADII, CULL_SEGMENTS, CULL_AMOUNTS) in a 1mi box
+func defaultRingPlan() RingPlan {
+	return RingPlan{
+		Radii:    RING_RADII,
+		Segments: CULL_SEGMENTS,
+		Amounts:  CULL_AMOUNTS,
+		BoxSize:  1,
+	}
+}
+
+// Function to size pickup rings from the straight-line trip distance and the rider's max walk (in mi, 0 if none).
+// Segments are left at the defaults until planSegments sees the streets.
+func planRings(source Location, destination Location, maxWalk float64) RingPlan {
+	// Step 1. Size the outer ring from the trip length
+	tripMiles := distanceMiles(source, destination)
+	outer := RING_BASE_RADIUS + RING_RADIUS_PER_TRIP_MILE*tripMiles
+	outer = math.Max(RING_MIN_RADIUS, math.Min(RING_MAX_RADIUS, outer))
+
+	// Step 2. Never walk further than the rider allows (even under RING_MIN_RADIUS)
+	if maxWalk > 0 {
+		outer = math.Min(outer, maxWalk)
+	}
+
+	// Step 3. Place the rings
+	radii := make([]float64, len(RING_FRACTIONS))
+	for i, fraction := range RING_FRACTIONS {
+		radii[i] = outer * fraction
+	}
+
+	// Step 4. Fetch just enough streets to cover the outer ring
+	return RingPlan{
+		Radii:    radii,
+		Segments: CULL_SEGMENTS,
+		Amounts:  CULL_AMOUNTS,
+		BoxSize:  2 * (outer + RING_BOX_MARGIN),
+	}
+}
+
+// Function to get the street density (mi of street per sq mi) in a size x size (mi) box around center
+func streetDensity(streets []Way, center Location, size float64) float64 {
+	left, bottom, right, top := getUserBoundingBox(size, center)
+
+	// Add up segments whose middle is inside the box
+	total := 0.0
+	for _, street := range streets {
+		for i := 1; i < len(street.Geometry); i++ {
+			middle := interpolateLocation(street.Geometry[i-1], street.Geometry[i], 0.5)
+			if !boxContains(left, bottom, right, top, middle) {
+				continue
+			}
+			total += distanceMiles(street.Geometry[i-1], street.Geometry[i])
+		}
+	}
+
+	return total / (size * size)
+}
+
+// Function to split the point budget between rings by how many streets each ring is expected to cross.
+// A ring of radius r in a street grid of density D crosses about 4*D*r streets, so sparse areas
+// and small rings stop paying for segments that will have nothing in them.
+func planSegments(plan RingPlan, density float64) RingPlan {
+	// Step 1. Estimate crossings per ring (a segment can't hold more than its crossings)
+	weights := make([]float64, len(plan.Radii))
+	totalWeight := 0.0
+	for i, radius := range plan.Radii {
+		weights[i] = math.Min(4*density*radius, float64(RING_MAX_SEGMENTS))
+		totalWeight += weights[i]
+	}
+
+	// Step 2. Keep the defaults if there's nothing to go on
+	if totalWeight == 0 {
+		return plan
+	}
+
+	// Step 3. Share out the budget
+	segments := make([]int, len(plan.Radii))
+	amounts := make([]int, len(plan.Radii))
+	for i := range plan.Radii {
+		share := float64(RING_POINT_BUDGET) * weights[i] / totalWeight
+		segments[i] = int(math.Max(1, math.Min(float64(RING_MAX_SEGMENTS), math.Round(math.Min(share, weights[i])))))
+		amounts[i] = 1
+	}
+
+	plan.Segments = segments
+	plan.Amounts = amounts
+	return plan
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlanRings(t *testing.T) {
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	near := Location{Latitude: 30.6 + milesToDegLatitude(1, 30.6), Longitude: -96.3}
+	far := Location{Latitude: 30.6 + milesToDegLatitude(20, 30.6), Longitude: -96.3}
+
+	// A 1mi ride walks at most 0.2mi
+	plan := planRings(source, near, 0)
+	if outer := plan.Radii[len(plan.Radii)-1]; math.Abs(outer-0.2) > 0.001 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", outer, 0.2)
+	}
+	if math.Abs(plan.BoxSize-0.6) > 0.001 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", plan.BoxSize, 0.6)
+	}
+
+	// A 20mi ride is capped at RING_MAX_RADIUS
+	plan = planRings(source, far, 0)
+	if outer := plan.Radii[len(plan.Radii)-1]; outer != RING_MAX_RADIUS {
+		t.Errorf("Result was incorrect, got: %f, want: %f", outer, RING_MAX_RADIUS)
+	}
+
+	// The rider's max walk wins
+	plan = planRings(source, far, 0.3)
+	if outer := plan.Radii[len(plan.Radii)-1]; outer != 0.3 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", outer, 0.3)
+	}
+
+	// Even when it's under RING_MIN_RADIUS
+	plan = planRings(source, far, 0.05)
+	if outer := plan.Radii[len(plan.Radii)-1]; outer != 0.05 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", outer, 0.05)
+	}
+}
+
+func TestStreetDensity(t *testing.T) {
+	center := Location{Latitude: 30.6, Longitude: -96.3}
+	west := Location{Latitude: 30.6, Longitude: -96.3 - milesToDegLongitude(0.5, 30.6)}
+	east := Location{Latitude: 30.6, Longitude: -96.3 + milesToDegLongitude(0.5, 30.6)}
+
+	// One 1mi street split into two segments, in a 1mi x 1mi box
+	response := streetDensity([]Way{NewWay(1, []Location{west, center, east}, nil)}, center, 1)
+	if math.Abs(response-1) > 0.001 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 1.0)
+	}
+}
+
+func TestPlanSegments(t *testing.T) {
+	plan := RingPlan{Radii: []float64{0.1, 0.25, 0.5, 0.75}, BoxSize: 1.7}
+
+	// Sparse: small rings expect too few crossings to be worth many segments
+	sparse := planSegments(plan, 2)
+	if sparse.Segments[0] != 1 {
+		t.Errorf("Fail: expected 1 segment on a small sparse ring, got %v", sparse.Segments)
+	}
+
+	// Dense: every ring gets several segments
+	dense := planSegments(plan, 40)
+	for _, segments := range dense.Segments {
+		if segments < 3 {
+			t.Errorf("Fail: expected several segments per dense ring, got %v", dense.Segments)
+		}
+	}
+
+	// Nothing to go on: defaults are kept
+	if empty := planSegments(defaultRingPlan(), 0); empty.Segments[0] != CULL_SEGMENTS[0] {
+		t.Errorf("Fail: expected default segments, got %v", empty.Segments)
+	}
+}
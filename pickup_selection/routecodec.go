@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Constant for the version of the cached route encoding.
+// Bump it whenever Route changes in a way old entries can't be read as, so they're treated as misses
+// (and overwritten) instead of being read back wrong.
+const ROUTE_CACHE_VERSION int = 2
+
+// A Route as it's stored in cache
+type cachedRoute struct {
+	Version int   `json:"v"`
+	Route   Route `json:"route"`
+	// When the route stops being fresh (unix time in sec, see StoreRoutesAsync)
+	FreshUntil int64 `json:"freshUntil"`
+}
+
+// Helper function to encode a route for the cache.
+// The whole Route is kept, including its exact coordinates, as keys are snapped to a grid (see routeCacheKey)
+func routeJSON(route Route, freshUntil int64) string {
+	data, err := json.Marshal(cachedRoute{
+		Version:    ROUTE_CACHE_VERSION,
+		Route:      route,
+		FreshUntil: freshUntil,
+	})
+	if err != nil {
+		// Route is plain data, so this can't happen
+		panic(err)
+	}
+	return string(data)
+}
+
+// Helper function to get route from JSON, and whether it's still fresh.
+// Returns nil if it can't be read, is from another version, or isn't for close enough to source -> destination.
+func parseCachedRoute(routeJSON string, source Location, destination Location) (*Route, bool) {
+	// Decode JSON
+	var cached cachedRoute
+	if err := json.Unmarshal([]byte(routeJSON), &cached); err != nil {
+		return nil, false
+	}
+
+	// Entries from before versioning have no version at all
+	if cached.Version != ROUTE_CACHE_VERSION {
+		return nil, false
+	}
+
+	// Check this was cached for (about) the same route
+	if !cachedRouteMatches(cached.Route.Source, cached.Route.Destination, source, destination) {
+		return nil, false
+	}
+
+	// Hand back the route for what was asked for, so callers can look it up by source
+	route := cached.Route
+	route.Source = source
+	route.Destination = destination
+	return &route, time.Now().Unix() < cached.FreshUntil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRouteJSONRoundTrip(t *testing.T) {
+	source := Location{Latitude: 30.6012345, Longitude: -96.3012345}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	route := Route{
+		LengthInMeters:                       1200,
+		TravelTimeInSeconds:                  300,
+		HistoricalTrafficTravelTimeInSeconds: 320,
+		NoTrafficTravelTimeInSeconds:         250,
+		TrafficDelayInSeconds:                50,
+		DepartureTime:                        "2024-06-04T17:00:00-05:00",
+		ArrivalTime:                          "2024-06-04T17:05:00-05:00",
+		Source:                               source,
+		Destination:                          destination,
+	}
+
+	// Every field comes back, departure and arrival times included
+	decoded, fresh := parseCachedRoute(routeJSON(route, time.Now().Unix()+60), source, destination)
+	if decoded == nil || *decoded != route {
+		t.Fatalf("Fail: expected %+v, got %+v", route, decoded)
+	}
+	if !fresh {
+		t.Errorf("Fail: expected the route to be fresh")
+	}
+
+	// Past fresh is still readable
+	if decoded, fresh := parseCachedRoute(routeJSON(route, time.Now().Unix()-1), source, destination); decoded == nil || fresh {
+		t.Errorf("Fail: expected a stale route, got %+v (fresh %t)", decoded, fresh)
+	}
+}
+
+func TestParseCachedRouteVersions(t *testing.T) {
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+
+	// Entries from before versioning
+	old := `{"lengthInMeters": 1200, "travelTimeInSeconds": 300, "trafficDelayInSeconds": 0, "historical": 300, "noTraffic": 300, "source": [30.6, -96.3], "destination": [30.7, -96.4]}`
+	if route, _ := parseCachedRoute(old, source, destination); route != nil {
+		t.Errorf("Fail: expected an unversioned entry to be a miss, got %+v", route)
+	}
+
+	// Entries from another version
+	other := fmt.Sprintf(`{"v": %d, "route": {"travelTimeInSeconds": 300}, "freshUntil": %d}`, ROUTE_CACHE_VERSION+1, time.Now().Unix()+60)
+	if route, _ := parseCachedRoute(other, source, destination); route != nil {
+		t.Errorf("Fail: expected an entry from another version to be a miss, got %+v", route)
+	}
+
+	// Garbage
+	if route, _ := parseCachedRoute("not json", source, destination); route != nil {
+		t.Errorf("Fail: expected garbage to be a miss, got %+v", route)
+	}
+}
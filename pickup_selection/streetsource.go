@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Somewhere to get street geometry from (Overpass, or a local OSM extract)
+type StreetSource interface {
+	// Get the streets matching streetQuery in a radius x radius (mi) box centered at center
+	GetStreets(radius float64, center Location, streetQuery StreetQuery) ([]Way, error)
+}
+
+// Street source backed by the live Overpass API
+type OverpassStreetSource struct {
+	// Overpass URL override for testing ("nil" to use overpass-api.de)
+	APIURL string
+}
+
+// Function to get streets from the Overpass API
+func (source OverpassStreetSource) GetStreets(radius float64, center Location, streetQuery StreetQuery) ([]Way, error) {
+	return getStreetGeometry(radius, center, streetQuery, source.APIURL)
+}
+
+// The street source used by HandleRequest, chosen once at cold start
+var streetSource StreetSource = OverpassStreetSource{APIURL: "nil"}
+
+// A single parsed Overpass QL tag filter, e.g. ["surface"!="unpaved"]
+type tagFilter struct {
+	Key    string
+	Value  string
+	Negate bool
+	Exists bool // only checks the key is present (or absent if Negate)
+}
+
+// Overpass QL tag filters that can be evaluated without Overpass
+var tagFilterPattern = regexp.MustCompile(`^\[(!?)"([^"]+)"(?:(!?=)"([^"]*)")?\]$`)
+
+// Helper function to parse extra filters into tag filters, for sources that can't run Overpass QL
+func parseTagFilters(filters []string) ([]tagFilter, error) {
+	var parsed []tagFilter
+	for _, filter := range filters {
+		match := tagFilterPattern.FindStringSubmatch(filter)
+		if match == nil {
+			return nil, fmt.Errorf("extra filter %q is not supported by this street source", filter)
+		}
+
+		// [!"key"] or ["key"]
+		if match[3] == "" {
+			parsed = append(parsed, tagFilter{Key: match[2], Negate: match[1] == "!", Exists: true})
+			continue
+		}
+
+		// ["key"="value"] or ["key"!="value"]
+		if match[1] == "!" {
+			return nil, fmt.Errorf("extra filter %q is not supported by this street source", filter)
+		}
+		parsed = append(parsed, tagFilter{Key: match[2], Value: match[4], Negate: match[3] == "!="})
+	}
+	return parsed, nil
+}
+
+// Helper function to check a way's tags against a StreetQuery the same way Overpass would
+func matchesStreetQuery(tags map[string]string, streetQuery StreetQuery, filters []tagFilter) bool {
+	// Must be one of the highway classes
+	classMatch := false
+	for _, class := range streetQuery.HighwayClasses {
+		if tags["highway"] == class {
+			classMatch = true
+			break
+		}
+	}
+	if !classMatch {
+		return false
+	}
+
+	// Must not have any excluded tag
+	for _, tag := range streetQuery.ExcludedTags {
+		key, value, _ := strings.Cut(tag, "=")
+		if existing, ok := tags[key]; ok && existing == value {
+			return false
+		}
+	}
+
+	// Must pass every extra filter
+	for _, filter := range filters {
+		value, ok := tags[filter.Key]
+		var pass bool
+		if filter.Exists {
+			pass = ok
+		} else {
+			pass = ok && value == filter.Value
+		}
+		if pass == filter.Negate {
+			return false
+		}
+	}
+
+	return true
+}
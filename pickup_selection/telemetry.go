@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry goes through the OpenTelemetry SDK and is exported over OTLP/HTTP (to OTEL_EXPORTER_OTLP_ENDPOINT).
+// Spans are batched in the background and flushed at the end of every request, as Lambda freezes the
+// container once it returns.
+
+// Constant for the longest the end of a request waits on the collector (traces and metrics flush side by side)
+const OTLP_FLUSH_TIMEOUT time.Duration = 500 * time.Millisecond
+
+// Constant for how long to skip flushing after the collector fails (spans queue up until then)
+const OTLP_BACKOFF time.Duration = 30 * time.Second
+
+// Constant for how often metrics are exported in the background (they're also flushed with every request)
+const OTLP_METRIC_INTERVAL time.Duration = time.Minute
+
+// Latency histogram bucket bounds (in ms)
+var LATENCY_BUCKETS = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Constant for the instrumentation scope name (and the default service name)
+const TELEMETRY_SCOPE string = "pickup-selection"
+
+// One timed stage of a request (or one upstream call)
+type Span struct {
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+// Providers exporting to the current endpoint, and the root span of the request being handled.
+// Lambda hands a container one request at a time, so there's one root span at a time.
+var telemetry = struct {
+	mutex          sync.Mutex
+	endpoint       string
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+	meter          metric.Meter
+	histograms     map[string]metric.Float64Histogram
+	counters       map[string]metric.Int64Counter
+	root           *Span
+	rootContext    context.Context
+	backoffUntil   time.Time
+}{}
+
+func init() {
+	// Exporter errors are logged like everything else
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		stageLog("telemetry").Warn("telemetry error", "error", err)
+	}))
+
+	// Nothing is exported until an endpoint is set
+	installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider())
+}
+
+// Helper function to get the resource this service reports as (OTEL_SERVICE_NAME)
+func telemetryResource() *resource.Resource {
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = TELEMETRY_SCOPE
+	}
+	return resource.NewSchemaless(attribute.String("service.name", name))
+}
+
+// Helper function to build providers exporting over OTLP/HTTP.
+// The exporters read OTEL_EXPORTER_OTLP_ENDPOINT (and the other OTEL_EXPORTER_OTLP_* settings) themselves.
+func newOTLPProviders() (*sdktrace.TracerProvider, *sdkmetric.MeterProvider, error) {
+	// Retrying would only hold the response up, so a failed export is dropped
+	ctx := context.Background()
+	traceExporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithTimeout(OTLP_FLUSH_TIMEOUT),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}))
+	if err != nil {
+		return nil, nil, err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithTimeout(OTLP_FLUSH_TIMEOUT),
+		otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{Enabled: false}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(telemetryResource()))
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(OTLP_METRIC_INTERVAL))),
+		sdkmetric.WithResource(telemetryResource()))
+	return tracerProvider, meterProvider, nil
+}
+
+// Helper function to switch providers, shutting down the old ones (which flushes what they still hold)
+func installTelemetry(endpoint string, tracerProvider *sdktrace.TracerProvider, meterProvider *sdkmetric.MeterProvider) {
+	telemetry.mutex.Lock()
+	oldTracerProvider, oldMeterProvider := telemetry.tracerProvider, telemetry.meterProvider
+	telemetry.endpoint = endpoint
+	telemetry.tracerProvider = tracerProvider
+	telemetry.meterProvider = meterProvider
+	telemetry.tracer = tracerProvider.Tracer(TELEMETRY_SCOPE)
+	telemetry.meter = meterProvider.Meter(TELEMETRY_SCOPE)
+	telemetry.histograms = make(map[string]metric.Float64Histogram)
+	telemetry.counters = make(map[string]metric.Int64Counter)
+	telemetry.backoffUntil = time.Time{}
+	telemetry.mutex.Unlock()
+
+	if oldTracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), OTLP_FLUSH_TIMEOUT)
+		defer cancel()
+		oldTracerProvider.Shutdown(ctx)
+		oldMeterProvider.Shutdown(ctx)
+	}
+}
+
+// Function to start the root span of a request, tagged with the Lambda request ID.
+// Sets up exporting whenever OTEL_EXPORTER_OTLP_ENDPOINT changes (i.e. on cold start).
+func startRequestTrace(ctx context.Context) {
+	telemetry.mutex.Lock()
+	current := telemetry.endpoint
+	telemetry.mutex.Unlock()
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != current {
+		if endpoint == "" {
+			installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider())
+		} else if tracerProvider, meterProvider, err := newOTLPProviders(); err != nil {
+			stageLog("telemetry").Warn("error setting up telemetry", "error", err)
+		} else {
+			installTelemetry(endpoint, tracerProvider, meterProvider)
+		}
+	}
+
+	var attrs []attribute.KeyValue
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		attrs = append(attrs, attribute.String("faas.invocation_id", lc.AwsRequestID))
+	}
+
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+	start := time.Now()
+	rootContext, root := telemetry.tracer.Start(context.Background(), "HandleRequest", trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	telemetry.root = &Span{name: "HandleRequest", start: start, span: root}
+	telemetry.rootContext = rootContext
+}
+
+// Function to start a span for one stage of the request (under its root span)
+func startSpan(name string) *Span {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	parent := telemetry.rootContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	start := time.Now()
+	_, span := telemetry.tracer.Start(parent, name, trace.WithTimestamp(start))
+	return &Span{name: name, start: start, span: span}
+}
+
+// Function to tag a span
+func (span *Span) SetAttr(key string, value string) {
+	span.span.SetAttributes(attribute.String(key, value))
+}
+
+// Function to mark a span as failed
+func (span *Span) SetError(err error) {
+	span.span.SetStatus(codes.Error, redactString(err.Error()))
+}
+
+// Function to end a span, recording how long it took in the stage latency histogram
+func (span *Span) End() {
+	end := time.Now()
+	span.span.End(trace.WithTimestamp(end))
+	recordLatency("pickup.stage.duration", end.Sub(span.start), map[string]string{"stage": span.name})
+}
+
+// Helper function to turn attributes into a measurement option, in key order
+func measurementAttrs(attrs map[string]string) metric.MeasurementOption {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]attribute.KeyValue, len(keys))
+	for i, key := range keys {
+		encoded[i] = attribute.String(key, attrs[key])
+	}
+	return metric.WithAttributes(encoded...)
+}
+
+// Function to record a latency in a histogram (in ms)
+func recordLatency(name string, latency time.Duration, attrs map[string]string) {
+	telemetry.mutex.Lock()
+	histogram, ok := telemetry.histograms[name]
+	if !ok {
+		var err error
+		histogram, err = telemetry.meter.Float64Histogram(name, metric.WithUnit("ms"), metric.WithExplicitBucketBoundaries(LATENCY_BUCKETS...))
+		if err != nil {
+			telemetry.mutex.Unlock()
+			stageLog("telemetry").Warn("error creating histogram", "name", name, "error", err)
+			return
+		}
+		telemetry.histograms[name] = histogram
+	}
+	telemetry.mutex.Unlock()
+
+	histogram.Record(context.Background(), float64(latency)/float64(time.Millisecond), measurementAttrs(attrs))
+}
+
+// Function to add to a counter
+func recordCount(name string, value int64, attrs map[string]string) {
+	telemetry.mutex.Lock()
+	counter, ok := telemetry.counters[name]
+	if !ok {
+		var err error
+		counter, err = telemetry.meter.Int64Counter(name)
+		if err != nil {
+			telemetry.mutex.Unlock()
+			stageLog("telemetry").Warn("error creating counter", "name", name, "error", err)
+			return
+		}
+		telemetry.counters[name] = counter
+	}
+	telemetry.mutex.Unlock()
+
+	counter.Add(context.Background(), value, measurementAttrs(attrs))
+}
+
+// Function to count cache hits and misses for one kind of entry (e.g. "tt", "ors", "price")
+func recordCacheLookups(prefix string, hits int, misses int) {
+	recordCount("pickup.cache.lookups", int64(hits), map[string]string{"prefix": prefix, "result": "hit"})
+	recordCount("pickup.cache.lookups", int64(misses), map[string]string{"prefix": prefix, "result": "miss"})
+}
+
+// Function to count an upstream call by its status code (or "error" if it never got one)
+func recordUpstream(provider string, res *http.Response, err error) {
+	status := "error"
+	if err == nil && res != nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	recordCount("pickup.upstream.requests", 1, map[string]string{"provider": provider, "status": status})
+}
+
+// Function to end the request's root span and flush spans and metrics to the collector.
+// Traces and metrics are flushed side by side, waiting at most OTLP_FLUSH_TIMEOUT in all. After a failed
+// flush the next OTLP_BACKOFF of requests skip it, so a collector that's down doesn't slow every ride.
+// Call before returning from a request, as Lambda freezes the container once it returns.
+func FlushTelemetry() {
+	telemetry.mutex.Lock()
+	root := telemetry.root
+	telemetry.root = nil
+	telemetry.rootContext = nil
+	skip := telemetry.endpoint == "" || time.Now().Before(telemetry.backoffUntil)
+	tracerProvider, meterProvider := telemetry.tracerProvider, telemetry.meterProvider
+	telemetry.mutex.Unlock()
+	if root != nil {
+		root.End()
+	}
+	if skip {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), OTLP_FLUSH_TIMEOUT)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { errs <- tracerProvider.ForceFlush(ctx) }()
+	go func() { errs <- meterProvider.ForceFlush(ctx) }()
+	for range 2 {
+		if err := <-errs; err != nil {
+			stageLog("telemetry").Warn("error exporting telemetry", "error", err, "backoff", OTLP_BACKOFF.String())
+			telemetry.mutex.Lock()
+			telemetry.backoffUntil = time.Now().Add(OTLP_BACKOFF)
+			telemetry.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFlushTelemetry(t *testing.T) {
+	// Fake OTLP collector
+	var mutex sync.Mutex
+	var spans []*tracepb.Span
+	var resource, metrics string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.URL.Path {
+		case "/v1/traces":
+			var export collectortrace.ExportTraceServiceRequest
+			if err := proto.Unmarshal(body, &export); err != nil {
+				t.Errorf("Fail: expected a protobuf trace export, got %s", err)
+			}
+			for _, resourceSpans := range export.ResourceSpans {
+				resource = protojson.Format(resourceSpans.Resource)
+				for _, scopeSpans := range resourceSpans.ScopeSpans {
+					spans = append(spans, scopeSpans.Spans...)
+				}
+			}
+		case "/v1/metrics":
+			var export collectormetrics.ExportMetricsServiceRequest
+			if err := proto.Unmarshal(body, &export); err != nil {
+				t.Errorf("Fail: expected a protobuf metrics export, got %s", err)
+			}
+			metrics = protojson.Format(&export)
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", ts.URL)
+	t.Setenv("OTEL_SERVICE_NAME", "pickup-test")
+	t.Cleanup(func() { installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider()) })
+
+	// One request with a stage, a failed upstream call and some cache lookups
+	startRequestTrace(lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "abc-123"}))
+	span := startSpan("geometry")
+	span.SetAttr("streets", "12")
+	span.End()
+	span = startSpan("overpass")
+	span.SetError(errors.New("timed out"))
+	span.End()
+	recordUpstream("overpass", nil, errors.New("timed out"))
+	recordCacheLookups("telemetry-test", 3, 1)
+	FlushTelemetry()
+
+	// Spans share the root's trace, and the root carries the request ID
+	mutex.Lock()
+	if len(spans) != 3 {
+		mutex.Unlock()
+		t.Fatalf("Fail: expected 3 spans, got %d", len(spans))
+	}
+	root := spans[2]
+	if root.Name != "HandleRequest" || !strings.Contains(root.String(), "abc-123") {
+		t.Errorf("Fail: expected the root span last with the request ID, got %s", root)
+	}
+	for _, span := range spans[:2] {
+		if hex.EncodeToString(span.TraceId) != hex.EncodeToString(root.TraceId) ||
+			hex.EncodeToString(span.ParentSpanId) != hex.EncodeToString(root.SpanId) {
+			t.Errorf("Fail: expected %s under the root span", span.Name)
+		}
+	}
+	if spans[1].Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("Fail: expected the failed span to have an error status, got %s", spans[1].Status)
+	}
+	if !strings.Contains(resource, "pickup-test") {
+		t.Errorf("Fail: expected the service name on the resource, got %s", resource)
+	}
+
+	// Metrics include the stage latency, the upstream status and cache hits
+	for _, want := range []string{`"pickup.stage.duration"`, `"geometry"`, `"pickup.upstream.requests"`, `"error"`, `"pickup.cache.lookups"`, `"telemetry-test"`} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Fail: expected %s in the metrics export, got %s", want, metrics)
+		}
+	}
+	spans = nil
+	mutex.Unlock()
+
+	// Spans are only exported once
+	FlushTelemetry()
+	mutex.Lock()
+	if len(spans) != 0 {
+		t.Errorf("Fail: expected no spans the second time, got %d", len(spans))
+	}
+	mutex.Unlock()
+}
+
+func TestFlushTelemetryCollectorDown(t *testing.T) {
+	// Collector that never answers in time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * OTLP_FLUSH_TIMEOUT)
+	}))
+	defer ts.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", ts.URL)
+	t.Cleanup(func() { installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider()) })
+
+	// The first flush waits at most the timeout (traces and metrics side by side)
+	startRequestTrace(context.Background())
+	startSpan("geometry").End()
+	start := time.Now()
+	FlushTelemetry()
+	if elapsed := time.Since(start); elapsed > OTLP_FLUSH_TIMEOUT+250*time.Millisecond {
+		t.Errorf("Fail: expected the flush to give up after %s, took %s", OTLP_FLUSH_TIMEOUT, elapsed)
+	}
+
+	// The next request doesn't wait at all
+	startRequestTrace(context.Background())
+	start = time.Now()
+	FlushTelemetry()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Fail: expected the flush to be skipped while backing off, took %s", elapsed)
+	}
+}
+
+func TestRecordLatencyBuckets(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	t.Cleanup(func() { installTelemetry("", sdktrace.NewTracerProvider(), sdkmetric.NewMeterProvider()) })
+
+	recordLatency("test.duration", 0, map[string]string{"stage": "bucket"})
+	recordLatency("test.duration", 10*time.Millisecond, map[string]string{"stage": "bucket"})
+	recordLatency("test.duration", time.Minute, map[string]string{"stage": "bucket"})
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	histogram, ok := collected.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+	if !ok || len(histogram.DataPoints) != 1 {
+		t.Fatalf("Fail: expected one histogram data point, got %+v", collected.ScopeMetrics[0].Metrics[0].Data)
+	}
+
+	// 0ms in the first bucket, 10ms on a bound in the second, a minute past the last bound
+	counts := histogram.DataPoints[0].BucketCounts
+	if histogram.DataPoints[0].Count != 3 || counts[0] != 1 || counts[1] != 1 || counts[len(LATENCY_BUCKETS)] != 1 {
+		t.Errorf("Fail: unexpected buckets %v", counts)
+	}
+}
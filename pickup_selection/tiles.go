@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Constant for the slippy-map zoom level streets are cached at (z15 is ~0.65mi across in Texas)
+const OSM_TILE_ZOOM int = 15
+
+// A slippy-map tile (https://wiki.openstreetmap.org/wiki/Slippy_map_tilenames)
+type MapTile struct {
+	Z int
+	X int
+	Y int
+}
+
+// Helper function to get the tile containing a coordinate
+func tileFor(longitude float64, latitude float64, zoom int) MapTile {
+	n := math.Exp2(float64(zoom))
+	phi := latitude * math.Pi / 180
+	return MapTile{
+		Z: zoom,
+		X: int(math.Floor((longitude + 180) / 360 * n)),
+		Y: int(math.Floor((1 - math.Log(math.Tan(phi)+1/math.Cos(phi))/math.Pi) / 2 * n)),
+	}
+}
+
+// Helper function to get the (left, bottom, right, top) bounding box of a tile
+func (tile MapTile) Bounds() (float64, float64, float64, float64) {
+	n := math.Exp2(float64(tile.Z))
+	toLongitude := func(x int) float64 {
+		return float64(x)/n*360 - 180
+	}
+	toLatitude := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return toLongitude(tile.X), toLatitude(tile.Y + 1), toLongitude(tile.X + 1), toLatitude(tile.Y)
+}
+
+// Helper function to get the tiles covering a (left, bottom, right, top) bounding box
+func coveringTiles(left float64, bottom float64, right float64, top float64, zoom int) []MapTile {
+	// Tile y grows southward (and x stops at the last tile, which ends at 180)
+	low := tileFor(left, top, zoom)
+	high := tileFor(right, bottom, zoom)
+	high.X = min(high.X, int(math.Exp2(float64(zoom)))-1)
+
+	var tiles []MapTile
+	for x := low.X; x <= high.X; x++ {
+		for y := low.Y; y <= high.Y; y++ {
+			tiles = append(tiles, MapTile{Z: zoom, X: x, Y: y})
+		}
+	}
+	return tiles
+}
+
+// Helper function to check whether two (left, bottom, right, top) boxes overlap
+func boxesOverlap(a [4]float64, b [4]float64) bool {
+	return a[0] <= b[2] && b[0] <= a[2] && a[1] <= b[3] && b[1] <= a[3]
+}
+
+// Street source backed by Overpass, fetched and cached by map tile,
+// so nearby requests with slightly different bounding boxes reuse the same streets
+type TiledStreetSource struct {
+	// Overpass URL override for testing ("nil" to use overpass-api.de)
+	APIURL string
+	Cache  RouteCache
+}
+
+// Helper function to get the cache key of a tile for a given street query
+func tileCacheKey(streetQuery StreetQuery, tile MapTile) string {
+	// Different queries keep different streets, so they can't share tiles
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%q", streetQuery)
+	return fmt.Sprintf("osm_%x_%d_%d_%d", hash.Sum64(), tile.Z, tile.X, tile.Y)
+}
+
+// Function to get streets from cached tiles, fetching any missing tiles from Overpass in one request
+// (one per side, across the antimeridian)
+func (source TiledStreetSource) GetStreets(radius float64, center Location, streetQuery StreetQuery) ([]Way, error) {
+	// Get ttl setting
+	ttl, err := strconv.Atoi(os.Getenv("OSM_TILE_TTL"))
+	if err != nil {
+		// Default to 1 week ttl
+		ttl = 60 * 60 * 24 * 7
+	}
+
+	// Step 1. Get bounding box (in two halves across the antimeridian) + covering tiles
+	left, bottom, right, top := getUserBoundingBox(radius, center)
+	boxes := splitAtAntimeridian(left, bottom, right, top)
+	var ways []Way
+	for _, box := range boxes {
+		tiles := coveringTiles(box[0], box[1], box[2], box[3], OSM_TILE_ZOOM)
+
+		// Step 2. Pull tiles from cache
+		var missedTiles []MapTile
+		for _, tile := range tiles {
+			if tileWays, ok := GetStreetTile(source.Cache, tileCacheKey(streetQuery, tile)); ok {
+				// Parse the tags again, only the raw OSM data is cached
+				for i, way := range tileWays {
+					tileWays[i] = NewWay(way.ID, way.Geometry, way.Tags)
+				}
+				ways = append(ways, tileWays...)
+			} else {
+				missedTiles = append(missedTiles, tile)
+			}
+		}
+
+		// Step 3. Fetch every missed tile (on this side) at once, then split the streets back into tiles
+		if len(missedTiles) > 0 {
+			missLeft, missBottom, missRight, missTop := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+			for _, tile := range missedTiles {
+				tileLeft, tileBottom, tileRight, tileTop := tile.Bounds()
+				missLeft = math.Min(missLeft, tileLeft)
+				missBottom = math.Min(missBottom, tileBottom)
+				missRight = math.Max(missRight, tileRight)
+				missTop = math.Max(missTop, tileTop)
+			}
+
+			fetched, err := getStreetGeometryInBox(streetQuery, missBottom, missLeft, missTop, missRight, source.APIURL)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, tile := range missedTiles {
+				tileLeft, tileBottom, tileRight, tileTop := tile.Bounds()
+				tileBox := [4]float64{tileLeft, tileBottom, tileRight, tileTop}
+
+				tileWays := []Way{}
+				for _, way := range fetched {
+					if boxesOverlap(wayBoundingBox(way), tileBox) {
+						tileWays = append(tileWays, way)
+					}
+				}
+
+				StoreStreetTile(source.Cache, tileCacheKey(streetQuery, tile), tileWays, int32(ttl))
+				ways = append(ways, tileWays...)
+			}
+		}
+	}
+
+	// Step 4. Keep one copy of each street that overlaps the request's bounding box
+	seen := make(map[int64]bool)
+	streets := []Way{}
+	for _, way := range ways {
+		overlaps := false
+		for _, box := range boxes {
+			overlaps = overlaps || boxesOverlap(wayBoundingBox(way), box)
+		}
+		if seen[way.ID] || !overlaps {
+			continue
+		}
+		seen[way.ID] = true
+		streets = append(streets, way)
+	}
+
+	return streets, nil
+}
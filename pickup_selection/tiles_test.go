@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestTileFor(t *testing.T) {
+	// Kyle Field, College Station
+	tile := tileFor(-96.3403, 30.6100, 15)
+	expected := MapTile{Z: 15, X: 7614, Y: 13454}
+	if tile != expected {
+		t.Errorf("Result was incorrect, got: %+v, want: %+v", tile, expected)
+	}
+
+	// The tile's bounds contain the point
+	left, bottom, right, top := tile.Bounds()
+	if -96.3403 < left || -96.3403 > right || 30.6100 < bottom || 30.6100 > top {
+		t.Errorf("Fail: tile bounds (%f, %f, %f, %f) do not contain the point", left, bottom, right, top)
+	}
+}
+
+func TestCoveringTiles(t *testing.T) {
+	left, bottom, right, top := getUserBoundingBox(1, Location{Latitude: 30.61, Longitude: -96.34})
+	tiles := coveringTiles(left, bottom, right, top, OSM_TILE_ZOOM)
+
+	// A 1mi box needs at least 2x2 z15 tiles, but not many more
+	if len(tiles) < 4 || len(tiles) > 9 {
+		t.Errorf("Fail: unexpected number of tiles %d", len(tiles))
+	}
+
+	// Every corner of the box is covered
+	for _, corner := range [][2]float64{{left, bottom}, {left, top}, {right, bottom}, {right, top}} {
+		covered := false
+		for _, tile := range tiles {
+			if tile == tileFor(corner[0], corner[1], OSM_TILE_ZOOM) {
+				covered = true
+			}
+		}
+		if !covered {
+			t.Errorf("Fail: corner %v is not covered", corner)
+		}
+	}
+}
+
+func TestTileCacheKey(t *testing.T) {
+	tile := MapTile{Z: 15, X: 7614, Y: 13454}
+	a := tileCacheKey(StreetQuery{HighwayClasses: []string{"primary"}}, tile)
+	b := tileCacheKey(StreetQuery{HighwayClasses: []string{"residential"}}, tile)
+	if a == b {
+		t.Errorf("Fail: different street queries share a cache key %s", a)
+	}
+}
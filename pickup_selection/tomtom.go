@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/valyala/fastjson"
 )
@@ -26,62 +28,117 @@ type Route struct {
 
 // Helper function to construct the URL for a single route.
 // Used within building a batch routing request.
-func ttCalculateRouteURL(src Location, dst Location) string {
-	return fmt.Sprintf(`/calculateRoute/%.6f,%.6f:%.6f,%.6f/json?travelMode=car&routeType=fastest&traffic=true&departAt=now&maxAlternatives=0&computeTravelTimeFor=all&routeRepresentation=summaryOnly`,
+// heading is the direction the car faces at src in degrees (or negative if unknown),
+// so TomTom starts the route the way the car is pointing instead of routing a U-turn.
+func ttCalculateRouteURL(src Location, dst Location, heading float64) string {
+	url := fmt.Sprintf(`/calculateRoute/%.6f,%.6f:%.6f,%.6f/json?travelMode=car&routeType=fastest&traffic=true&departAt=now&maxAlternatives=0&computeTravelTimeFor=all&routeRepresentation=summaryOnly&sectionType=traffic`,
 		src.Latitude,
 		src.Longitude,
 		dst.Latitude,
 		dst.Longitude)
+
+	// Add the heading hint
+	if heading >= 0 {
+		url += fmt.Sprintf("&vehicleHeading=%d", int(math.Round(heading))%360)
+	}
+
+	return url
 }
 
-// Get a list of routes from TomTom
-func getTomTomRoutes(sources []Location, destination Location) []Route {
+// Constant for how long a TomTom request may take before giving up on it
+const TOMTOM_TIMEOUT time.Duration = 10 * time.Second
+
+// HTTP client for TomTom requests
+var tomtomClient = &http.Client{Timeout: TOMTOM_TIMEOUT}
+
+// Get a list of routes from TomTom, going through cache first
+// headings[i] is the car's heading at sources[i] (or -1 if unknown)
+// Returns a route for each source, and whether it could be routed.
+// Stale cached routes are returned as-is and refreshed in the background (see TomTomRouteTTL).
+func getTomTomRoutes(cache RouteCache, sources []Location, headings []float64, destination Location) ([]Route, []bool) {
 	// If source empty, return empty
 	if len(sources) == 0 {
-		return []Route{}
+		return []Route{}, []bool{}
 	}
 
-	// Make response array
-	routes := make([]Route, len(sources))
-
-	// Build src lookup, destinations
-	lookup := make(map[Location]int)
+	// Build destinations
 	destinations := make([]Location, len(sources))
-	for i, src := range sources {
-		lookup[src] = i
+	for i := range sources {
 		destinations[i] = destination
 	}
 
-	// Get PromCache
-	cache := NewPromCache()
+	// Pull from cache
+	// (by index, as the same source can come up again with another heading)
+	routes, missedIndices, staleIndices := GetRoutes(cache, "tt", sources, headings, destinations)
+	routed := make([]bool, len(sources))
+	for i := range routed {
+		routed[i] = true
+	}
+	for _, i := range missedIndices {
+		routed[i] = false
+	}
 
-	// Get ttl setting
-	ttl, err := strconv.Atoi(os.Getenv("TT_TTL"))
-	if err != nil {
-		// Default to 5min ttl
-		ttl = 60 * 5
+	// Fetch routes from TomTom and store the routed ones in cache in the background
+	fetch := func(sources []Location, headings []float64) ([]Route, []bool) {
+		fetched, fetchedRouted, err := fetchTomTomRoutes(cache, sources, headings, destination)
+		if err != nil {
+			stageLog("tomtom").Error("error fetching routes", "error", err)
+			return nil, nil
+		}
+		var store []Route
+		var storeHeadings []float64
+		for i, route := range fetched {
+			if fetchedRouted[i] {
+				store = append(store, route)
+				storeHeadings = append(storeHeadings, headings[i])
+			}
+		}
+		StoreRoutesAsync(cache, "tt", store, storeHeadings, TomTomRouteTTL(time.Now()))
+		return fetched, fetchedRouted
 	}
 
-	// Pull from cache
-	cachedRoutes, missedSrcs, _ := cache.GetRoutes("tt", sources, destinations)
-	for _, route := range cachedRoutes {
-		// Insert into proper index
-		i := lookup[route.Source]
-		routes[i] = route
+	// Refresh stale routes in the background, sharing the work with any other request refreshing them,
+	// unless TomTom is past a quota budget, where stale is better than billable.
+	// The stale routes are returned without waiting for it, but FlushCacheWrites waits for it like any cache write
+	// (bounded by INFLIGHT_WAIT and TOMTOM_TIMEOUT), so Lambda never freezes a refresh halfway.
+	if len(staleIndices) > 0 && budgetMode("tomtom") == "normal" {
+		staleSrcs, staleHeadings := sourcesAt(sources, headings, staleIndices)
+		pendingCacheWrites.Add(1)
+		go func() {
+			defer pendingCacheWrites.Done()
+			stageLog("tomtom").Info("refreshing stale routes", "count", len(staleSrcs))
+			coalesceRoutes(cache, "tt", tomtomFlights, staleSrcs, staleHeadings, destination, fetch)
+		}()
 	}
 
 	// If there were no missed sources, simply return routes
-	if len(missedSrcs) == 0 {
-		return routes
+	if len(missedIndices) == 0 {
+		return routes, routed
 	}
 
+	// Fetch the missed routes, sharing the work with any other request fetching them
+	missedSources, missedHeadings := sourcesAt(sources, headings, missedIndices)
+	for k, route := range coalesceRoutes(cache, "tt", tomtomFlights, missedSources, missedHeadings, destination, fetch) {
+		// Add to routes in proper index
+		if route != nil {
+			routes[missedIndices[k]] = *route
+			routed[missedIndices[k]] = true
+		}
+	}
+
+	return routes, routed
+}
+
+// Get a list of routes from TomTom in one batch request (cache only counts the billable routes)
+// headings[i] is the car's heading at sources[i] (or -1 if unknown)
+// Returns a route for each source, and whether TomTom could route it.
+func fetchTomTomRoutes(cache RouteCache, sources []Location, headings []float64, destination Location) ([]Route, []bool, error) {
 	// Start request body
 	requestBody := `{"batchItems":[`
 
 	// Add (src,dst) pairs
-	for _, source := range missedSrcs {
-		fmt.Printf("Cache hit @ (%.6f, %.6f)->(%.6f, %.6f)\n", source.Latitude, source.Longitude, destination.Latitude, destination.Longitude)
-		requestBody += fmt.Sprintf(`{"query": "%s"},`, ttCalculateRouteURL(source, destination))
+	for i, source := range sources {
+		requestBody += fmt.Sprintf(`{"query": "%s"},`, ttCalculateRouteURL(source, destination, headings[i]))
 	}
 
 	// Trim trailing comma
@@ -90,44 +147,60 @@ func getTomTomRoutes(sources []Location, destination Location) []Route {
 	// Finish request body
 	requestBody += `]}`
 
-	// PRINT REQUEST BODY
-	fmt.Println(string(requestBody))
+	stageLog("tomtom").Info("requesting routes", "count", len(sources), "destination", destination)
+	stageLog("tomtom").Debug("tomtom request", "body", requestBody)
 
 	// Now get the URL
 	url := os.Getenv("TOMTOM_API_URL") + os.Getenv("TOMTOM_API_KEY")
 
 	// Make the request
-	res, err := http.Post(url, "application/json", strings.NewReader(requestBody))
+	span := startSpan("tomtom.batch")
+	span.SetAttr("items", strconv.Itoa(len(sources)))
+	defer span.End()
+	res, err := tomtomClient.Post(url, "application/json", strings.NewReader(requestBody))
+	recordUpstream("tomtom", res, err)
 	if err != nil {
-		fmt.Printf("Error making http request: %s", err)
-		os.Exit(1)
+		span.SetError(err)
+		return nil, nil, fmt.Errorf("making http request: %w", err)
 	}
+	defer res.Body.Close()
 
 	// Decode the response
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Printf("Error reading response body: %s", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("reading TomTom response: %w", err)
 	}
 
-	// PRINT RESPONSE BODY
-	fmt.Println(string(resBody))
+	stageLog("tomtom").Debug("tomtom response", "status", res.StatusCode, "body", string(resBody))
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("TomTom returned status %d", res.StatusCode)
+	}
+	recordBillable(cache, "tomtom", len(sources))
 
 	// Decode the response JSON
 	var p fastjson.Parser
 	v, err := p.Parse(string(resBody))
 	if err != nil {
-		fmt.Printf("Error parsing response JSON: %s", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("parsing TomTom response: %w", err)
 	}
 
-	// Step 1. Loop through the data array
+	// Loop through the data array (items come back in the order they were asked for)
+	routes := make([]Route, len(sources))
+	routed := make([]bool, len(sources))
 	for i, route := range v.GetArray("batchItems") {
+		// Skip items that couldn't be routed (these carry an error instead of routes)
+		summaries := route.Get("response").GetArray("routes")
+		if i >= len(sources) || len(summaries) == 0 {
+			stageLog("tomtom").Warn("batch item not routed", "item", i, "error", string(route.GetStringBytes("response", "error", "description")))
+			continue
+		}
+
 		// Get the route summary
-		routeSummary := route.Get("response").GetArray("routes")[0].Get("summary")
+		routeSummary := summaries[0].Get("summary")
 
 		// Create a new route
-		newRoute := Route{
+		routes[i] = Route{
 			LengthInMeters:                       routeSummary.GetInt("lengthInMeters"),
 			TravelTimeInSeconds:                  routeSummary.GetInt("travelTimeInSeconds"),
 			HistoricalTrafficTravelTimeInSeconds: routeSummary.GetInt("historicTrafficTravelTimeInSeconds"),
@@ -135,16 +208,111 @@ func getTomTomRoutes(sources []Location, destination Location) []Route {
 			TrafficDelayInSeconds:                routeSummary.GetInt("trafficDelayInSeconds"),
 			DepartureTime:                        string(routeSummary.GetStringBytes("departureTime")),
 			ArrivalTime:                          string(routeSummary.GetStringBytes("arrivalTime")),
-			Source:                               missedSrcs[i],
+			Source:                               sources[i],
 			Destination:                          destination,
 		}
+		routed[i] = true
+	}
 
-		// Add to routes in proper index
-		routes[lookup[newRoute.Source]] = newRoute
+	return routes, routed, nil
+}
+
+// Get routes from every origin to every destination from the TomTom Matrix Routing API.
+// Returns routes in row-major order: routes[i*len(destinations)+j] is origins[i] -> destinations[j],
+// and whether each cell could be routed.
+// The matrix API has no historic traffic times, so these routes can be compared but not priced
+// (the no-traffic time is worked out from the traffic delay).
+// The cells are counted against today's quota in cache.
+func getTomTomMatrix(cache RouteCache, origins []Location, destinations []Location) ([]Route, []bool, error) {
+	// If either side empty, return empty
+	if len(origins) == 0 || len(destinations) == 0 {
+		return []Route{}, []bool{}, nil
+	}
+
+	// Start request body
+	requestBody := `{"origins":[`
+	for i, origin := range origins {
+		if i > 0 {
+			requestBody += ","
+		}
+		requestBody += fmt.Sprintf(`{"point":{"latitude":%.6f,"longitude":%.6f}}`, origin.Latitude, origin.Longitude)
+	}
+
+	// Add destinations
+	requestBody += `],"destinations":[`
+	for i, destination := range destinations {
+		if i > 0 {
+			requestBody += ","
+		}
+		requestBody += fmt.Sprintf(`{"point":{"latitude":%.6f,"longitude":%.6f}}`, destination.Latitude, destination.Longitude)
+	}
+
+	// Finish request body with the same routing options as the batch routes
+	requestBody += `],"options":{"departAt":"now","routeType":"fastest","traffic":"live","travelMode":"car"}}`
+
+	// Now get the URL
+	url := os.Getenv("TOMTOM_MATRIX_URL")
+	if url == "" {
+		url = "https://api.tomtom.com/routing/matrix/2?key="
+	}
+	url += os.Getenv("TOMTOM_API_KEY")
+
+	// Make the request
+	span := startSpan("tomtom.matrix")
+	span.SetAttr("cells", strconv.Itoa(len(origins)*len(destinations)))
+	defer span.End()
+	res, err := tomtomClient.Post(url, "application/json", strings.NewReader(requestBody))
+	recordUpstream("tomtom", res, err)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, fmt.Errorf("making http request: %w", err)
+	}
+	defer res.Body.Close()
 
-		// Store this route in memcache
-		cache.StoreRoute("tt", newRoute, int32(ttl))
+	// Decode the response
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading TomTom response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("TomTom returned status %d", res.StatusCode)
+	}
+	recordBillable(cache, "tomtom", len(origins)*len(destinations))
+
+	// Decode the response JSON
+	var p fastjson.Parser
+	v, err := p.Parse(string(resBody))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing TomTom response: %w", err)
+	}
+
+	// Place each cell by its indices (cells may come back in any order)
+	routes := make([]Route, len(origins)*len(destinations))
+	routed := make([]bool, len(routes))
+	for _, cell := range v.GetArray("data") {
+		i := cell.GetInt("originIndex")
+		j := cell.GetInt("destinationIndex")
+		summary := cell.Get("routeSummary")
+		if i < 0 || i >= len(origins) || j < 0 || j >= len(destinations) || summary == nil {
+			continue
+		}
+
+		travelTime := summary.GetInt("travelTimeInSeconds")
+		noTrafficTime := travelTime - summary.GetInt("trafficDelayInSeconds")
+
+		routes[i*len(destinations)+j] = Route{
+			LengthInMeters:               summary.GetInt("lengthInMeters"),
+			TravelTimeInSeconds:          travelTime,
+			NoTrafficTravelTimeInSeconds: noTrafficTime,
+			TrafficDelayInSeconds:        summary.GetInt("trafficDelayInSeconds"),
+			DepartureTime:                string(summary.GetStringBytes("departureTime")),
+			ArrivalTime:                  string(summary.GetStringBytes("arrivalTime")),
+			Source:                       origins[i],
+			Destination:                  destinations[j],
+		}
+		routed[i*len(destinations)+j] = true
 	}
 
-	return routes
+	return routes, routed, nil
 }
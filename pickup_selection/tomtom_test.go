@@ -1,53 +1,199 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestLocationToJSON(t *testing.T) {
+func TestTtCalculateRouteURL(t *testing.T) {
+	test_source := Location{Latitude: 30.245234235, Longitude: -96.352341235}
+	test_destination := Location{Latitude: 30.5325234235, Longitude: -96.742341235}
 
-	test_location := Location{
-		Latitude:  30.532431,
-		Longitude: 92.352342,
+	// Route with a heading hint
+	url := ttCalculateRouteURL(test_source, test_destination, 89.6)
+	if !strings.HasPrefix(url, "/calculateRoute/30.245234,-96.352341:30.532523,-96.742341/json?") {
+		t.Errorf("Fail: unexpected route URL, got: %s", url)
+	}
+	if !strings.Contains(url, "&vehicleHeading=90") {
+		t.Errorf("Fail: expected vehicleHeading=90, got: %s", url)
 	}
 
-	response := locationToJSON(test_location)
-	expected := "{\"latitude\": 30.532431, \"longitude\": 92.352342}"
-	if response != expected {
-		t.Errorf("Fail: response was not what was expected, got: %s. expected: %s", response, expected)
+	// Route with an unknown heading
+	url = ttCalculateRouteURL(test_source, test_destination, -1)
+	if strings.Contains(url, "vehicleHeading") {
+		t.Errorf("Fail: expected no vehicleHeading, got: %s", url)
 	}
 }
 
-// TODO: rewrite to handle the non-matrix nature of this request now
-func TestMakeBatchSSMDRoutingRequest(t *testing.T) {
+func TestGetTomTomMatrix(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"origins":[{"point":{"latitude":30.600000,"longitude":-96.300000}}`) {
+			t.Errorf("Fail: unexpected request body %s", body)
+		}
+		w.WriteHeader(200)
+		// Cells out of order, and one that couldn't be routed
+		w.Write([]byte(`{"data":[{"originIndex":0,"destinationIndex":1,"routeSummary":{"lengthInMeters":2000,"travelTimeInSeconds":300,"trafficDelayInSeconds":60}},{"originIndex":0,"destinationIndex":0,"routeSummary":{"lengthInMeters":1000,"travelTimeInSeconds":120,"trafficDelayInSeconds":0}},{"originIndex":1,"destinationIndex":0,"detailedError":{"code":"NO_ROUTE_FOUND"}}]}`))
+	}))
+	defer ts.Close()
+	t.Setenv("TOMTOM_MATRIX_URL", ts.URL+"?key=")
 
-	test_sources := []Location{
-		{Latitude: 30.245234235, Longitude: 93.352341235},
-		{Latitude: 30.265234235, Longitude: 93.232341235},
-		{Latitude: 30.635234235, Longitude: 93.632341235},
+	origins := []Location{{Latitude: 30.6, Longitude: -96.3}, {Latitude: 30.61, Longitude: -96.3}}
+	destinations := []Location{{Latitude: 30.7, Longitude: -96.3}, {Latitude: 30.71, Longitude: -96.3}}
+	cache := NewLRUCache(10)
+	routes, routed, err := getTomTomMatrix(cache, origins, destinations)
+	if err != nil {
+		t.Fatalf("Fail: unexpected error %s", err)
+	}
+	if len(routes) != 4 {
+		t.Fatalf("Fail: expected 4 routes, got %d", len(routes))
 	}
-	test_destinations := []Location{
-		{Latitude: 30.5325234235, Longitude: 93.742341235},
-		{Latitude: 30.645234235, Longitude: 93.632341235},
-		{Latitude: 30.355234235, Longitude: 93.362341235},
+	if !routed[0] || !routed[1] || routed[2] || routed[3] {
+		t.Errorf("Fail: unexpected routed cells %v", routed)
+	}
+	if routes[1].Source != origins[0] || routes[1].Destination != destinations[1] || routes[1].LengthInMeters != 2000 {
+		t.Errorf("Fail: cell was not placed by its indices, got %+v", routes[1])
+	}
+	if routes[1].NoTrafficTravelTimeInSeconds != 240 {
+		t.Errorf("Fail: expected no traffic time of 240, got %d", routes[1].NoTrafficTravelTimeInSeconds)
+	}
+
+	// A failed request is an error, not an exit
+	t.Setenv("TOMTOM_MATRIX_URL", "http://127.0.0.1:1/?key=")
+	if _, _, err := getTomTomMatrix(cache, origins, destinations); err == nil {
+		t.Errorf("Fail: expected an error from an unreachable TomTom")
 	}
 
+	// Only the answered request is billed, against the cache it was given
+	FlushCacheWrites()
+	if used := GetUsage(cache)[0].Used; used != 4 {
+		t.Errorf("Fail: expected 4 billable cells, got %d", used)
+	}
+}
+
+func TestGetTomTomRoutesStaleWhileRevalidate(t *testing.T) {
+	refreshed := make(chan string, 1)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		refreshed <- string(body)
 		w.WriteHeader(200)
-		//w.Write([]byte(`{"durations":[[0,74076.57,1767380.88,7558253],[74076.57,0,1712921.25,7503793.5],[1767380.88,1712921.25,0,5797053.5],[7558253,7503793.5,5797053.5,0]],"destinations":[{"location":[9.700817,48.476406],"snapped_distance":118.9},{"location":[9.207773,49.153882],"snapped_distance":10.54},{"location":[37.572963,55.801279],"snapped_distance":17.44},{"location":[115.665017,38.100717],"snapped_distance":648.79}],"sources":[{"location":[9.700817,48.476406],"snapped_distance":118.9},{"location":[9.207773,49.153882],"snapped_distance":10.54},{"location":[37.572963,55.801279],"snapped_distance":17.44},{"location":[115.665017,38.100717],"snapped_distance":648.79}],"metadata":{"attribution":"openrouteservice.org | OpenStreetMap contributors","service":"matrix","timestamp":1712591855420,"query":{"locations":[[9.70093,48.477473],[9.207916,49.153868],[37.573242,55.801281],[115.663757,38.106467]],"profile":"foot-walking","responseType":"json"},"engine":{"version":"7.1.1","build_date":"2024-01-29T14:41:12Z","graph_date":"2024-03-25T03:50:25Z"}}}`))
-		w.Write([]byte(`{"data":[{"originIndex":0,"destinationIndex":0,"routeSummary":{"lengthInMeters":681999,"travelTimeInSeconds":25106,"trafficDelayInSeconds":1769,"departureTime":"2018-08-10T10:20:42+02:00","arrivalTime":"2018-08-10T17:19:07+02:00"}},{"originIndex":0,"destinationIndex":0,"routeSummary":{"lengthInMeters":681999,"travelTimeInSeconds":25106,"trafficDelayInSeconds":1769,"departureTime":"2018-08-10T10:20:42+02:00","arrivalTime":"2018-08-10T17:19:07+02:00"}}]}`))
+		w.Write([]byte(`{"batchItems":[{"response":{"routes":[{"summary":{"lengthInMeters":1000,"travelTimeInSeconds":200}}]}}]}`))
+	}))
+	defer ts.Close()
+	t.Setenv("TOMTOM_API_URL", ts.URL+"?key=")
+	t.Setenv("TT_STALE_TTL", "600")
+
+	// Cache a route that's past fresh, but not yet expired
+	cache := NewLRUCache(10)
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	cache.Set(routeCacheKey("tt", source, -1, destination), routeJSON(Route{TravelTimeInSeconds: 300, Source: source, Destination: destination}, time.Now().Unix()-1), 600)
+
+	// The stale route is served right away...
+	routes, routed := getTomTomRoutes(cache, []Location{source}, []float64{-1}, destination)
+	if len(routes) != 1 || !routed[0] || routes[0].TravelTimeInSeconds != 300 {
+		t.Fatalf("Fail: expected the stale route to be served, got %+v", routes)
+	}
+
+	// ...and refreshed in the background, without holding up the routes
+	select {
+	case body := <-refreshed:
+		if !strings.Contains(body, "30.600000,-96.300000") {
+			t.Errorf("Fail: unexpected refresh request %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Fail: expected the stale route to be refreshed")
+	}
+
+	// Waiting for cache writes waits for the refresh too
+	FlushCacheWrites()
+	if route := GetRoute(cache, "tt", source, destination); route == nil || route.TravelTimeInSeconds != 200 {
+		t.Errorf("Fail: expected the refreshed route in cache once cache writes are flushed, got %+v", route)
+	}
+}
 
+func TestGetTomTomRoutesDuplicateSources(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		items := strings.Count(string(body), `"query"`)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"batchItems":[` + strings.TrimSuffix(strings.Repeat(`{"response":{"routes":[{"summary":{"lengthInMeters":1000,"travelTimeInSeconds":200,"historicTrafficTravelTimeInSeconds":200,"noTrafficTravelTimeInSeconds":180}}]}},`, items), ",") + `]}`))
+	}))
+	defer ts.Close()
+	t.Setenv("TOMTOM_API_URL", ts.URL+"?key=")
+
+	// The same pickup twice gets a route in both places
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	routes, routed := getTomTomRoutes(NewLRUCache(10), []Location{source, source}, []float64{-1, -1}, destination)
+	FlushCacheWrites()
+	if len(routes) != 2 {
+		t.Fatalf("Fail: expected 2 routes, got %d", len(routes))
+	}
+	for i, route := range routes {
+		if !routed[i] || route.TravelTimeInSeconds != 200 || route.Source != source {
+			t.Errorf("Fail: expected route %d to be filled, got %+v", i, route)
+		}
+	}
+}
+
+func TestGetTomTomRoutesUnroutedItem(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"batchItems":[{"statusCode":400,"response":{"error":{"description":"NO_ROUTE_FOUND"}}},{"statusCode":200,"response":{"routes":[{"summary":{"lengthInMeters":1000,"travelTimeInSeconds":200}}]}}]}`))
 	}))
 	defer ts.Close()
-	ThirdPartyURL := ts.URL
-	t.Setenv("TOMTOM_API_URL", string(ThirdPartyURL))
+	t.Setenv("TOMTOM_API_URL", ts.URL+"?key=")
+	t.Setenv("CACHE_ORIGIN_GRID_METERS", "0")
 
-	routes := ttCalculateRouteURL(test_sources, test_destinations, "car")
+	// The first pickup can't be routed, the second can
+	sources := []Location{{Latitude: 30.6, Longitude: -96.3}, {Latitude: 30.61, Longitude: -96.3}}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	routes, routed := getTomTomRoutes(NewLRUCache(10), sources, []float64{-1, -1}, destination)
+	FlushCacheWrites()
+	if routed[0] || !routed[1] {
+		t.Fatalf("Fail: expected only the second pickup routed, got %v", routed)
+	}
+	if routes[1].Source != sources[1] || routes[1].TravelTimeInSeconds != 200 {
+		t.Errorf("Fail: expected the second route in place, got %+v", routes[1])
+	}
 
-	if routes[0].LengthInMeters != 681999 {
-		t.Errorf("Fail: Unexpected return from function")
+	// A failed request is an error, not an exit
+	t.Setenv("TOMTOM_API_URL", "http://127.0.0.1:1/?key=")
+	if _, _, err := fetchTomTomRoutes(NewLRUCache(10), sources, []float64{-1, -1}, destination); err == nil {
+		t.Errorf("Fail: expected an error from an unreachable TomTom")
 	}
+}
 
+func TestGetTomTomRoutesSameSourceTwoHeadings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "vehicleHeading=180") || strings.Count(string(body), `"query"`) != 1 {
+			t.Errorf("Fail: expected only the southbound route fetched, got %s", body)
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"batchItems":[{"response":{"routes":[{"summary":{"lengthInMeters":3000,"travelTimeInSeconds":500}}]}}]}`))
+	}))
+	defer ts.Close()
+	t.Setenv("TOMTOM_API_URL", ts.URL+"?key=")
+
+	// The pickup is cached facing north, but not facing south
+	cache := NewLRUCache(10)
+	source := Location{Latitude: 30.6, Longitude: -96.3}
+	destination := Location{Latitude: 30.7, Longitude: -96.4}
+	cache.Set(routeCacheKey("tt", source, 0, destination), routeJSON(Route{TravelTimeInSeconds: 200, Source: source, Destination: destination}, time.Now().Unix()+60), 60)
+
+	// Each heading gets its own route, in its own place
+	routes, routed := getTomTomRoutes(cache, []Location{source, source}, []float64{180, 0}, destination)
+	FlushCacheWrites()
+	if !routed[0] || !routed[1] {
+		t.Fatalf("Fail: expected both routed, got %v", routed)
+	}
+	if routes[0].TravelTimeInSeconds != 500 || routes[1].TravelTimeInSeconds != 200 {
+		t.Errorf("Fail: expected the fetched route first and the cached one second, got %+v", routes)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Constants for the shortest and longest a drive stays fresh in cache (in sec, unless the base ttl is outside them)
+const ROUTE_MIN_TTL float64 = 60
+const ROUTE_MAX_TTL float64 = 60 * 60
+
+// Constant for the share of a drive spent in traffic delay past which traffic is considered heavy
+const ROUTE_HEAVY_DELAY_RATIO float64 = 0.25
+
+// How long a cached route is fresh, and how much longer it may be served stale while it's refreshed (in sec)
+type RouteTTL func(route Route) (int32, int32)
+
+// Function to get a RouteTTL that's the same for every route, with no stale period
+func FixedTTL(ttl int32) RouteTTL {
+	return func(Route) (int32, int32) {
+		return ttl, 0
+	}
+}
+
+// Helper function to get how much more (or less) traffic changes at a given time than usual.
+// Rush hours change fastest, nights barely change.
+func trafficVolatility(now time.Time) float64 {
+	// TODO: in future we would want the user's time zone...
+	// assume CDT for now (like pricing)
+	now = now.In(time.FixedZone("CDT", -5*60*60))
+	hour := now.Hour()
+
+	weekday := now.Weekday() != time.Saturday && now.Weekday() != time.Sunday
+	switch {
+	case weekday && (hour >= 7 && hour < 9 || hour >= 16 && hour < 19):
+		return 2
+	case hour >= 22 || hour < 6:
+		return 1.0 / 3
+	default:
+		return 1
+	}
+}
+
+// Function to get how long a drive stays fresh (in sec), from a base ttl.
+// Drives are refreshed sooner at rush hour and when they're stuck in traffic, and kept longer
+// at night and when traffic is flowing freely.
+func trafficTTL(route Route, base float64, now time.Time) int32 {
+	ttl := base / trafficVolatility(now)
+
+	// Traffic that's already bad can get better or worse quickly
+	if route.TravelTimeInSeconds > 0 {
+		delayRatio := float64(route.TrafficDelayInSeconds) / float64(route.TravelTimeInSeconds)
+		if delayRatio >= ROUTE_HEAVY_DELAY_RATIO {
+			ttl /= 2
+		} else if route.TrafficDelayInSeconds == 0 {
+			ttl *= 2
+		}
+	}
+
+	return int32(math.Max(math.Min(ROUTE_MIN_TTL, base), math.Min(math.Max(ROUTE_MAX_TTL, base), ttl)))
+}
+
+// Function to get the RouteTTL for TomTom drives.
+// TT_TTL is the base ttl (default 5min), TT_STALE_TTL how long past that a drive may be served
+// while it's refreshed in the background (default 0, off).
+func TomTomRouteTTL(now time.Time) RouteTTL {
+	base, err := strconv.Atoi(os.Getenv("TT_TTL"))
+	if err != nil {
+		// Default to 5min ttl
+		base = 60 * 5
+	}
+	stale, err := strconv.Atoi(os.Getenv("TT_STALE_TTL"))
+	if err != nil || stale < 0 {
+		stale = 0
+	}
+
+	return func(route Route) (int32, int32) {
+		return trafficTTL(route, float64(base), now), int32(stale)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficVolatility(t *testing.T) {
+	cdt := time.FixedZone("CDT", -5*60*60)
+
+	// Tuesday morning rush hour
+	if v := trafficVolatility(time.Date(2024, 6, 4, 8, 0, 0, 0, cdt)); v != 2 {
+		t.Errorf("Fail: expected rush hour volatility of 2, got %f", v)
+	}
+	// Saturday morning isn't rush hour
+	if v := trafficVolatility(time.Date(2024, 6, 8, 8, 0, 0, 0, cdt)); v != 1 {
+		t.Errorf("Fail: expected weekend volatility of 1, got %f", v)
+	}
+	// 3am (given in UTC)
+	if v := trafficVolatility(time.Date(2024, 6, 4, 8, 0, 0, 0, time.UTC)); v != 1.0/3 {
+		t.Errorf("Fail: expected night volatility of 1/3, got %f", v)
+	}
+}
+
+func TestTrafficTTL(t *testing.T) {
+	cdt := time.FixedZone("CDT", -5*60*60)
+	midday := time.Date(2024, 6, 4, 12, 0, 0, 0, cdt)
+	rushHour := time.Date(2024, 6, 4, 17, 0, 0, 0, cdt)
+	night := time.Date(2024, 6, 4, 2, 0, 0, 0, cdt)
+
+	moving := Route{TravelTimeInSeconds: 600, TrafficDelayInSeconds: 60}
+	jammed := Route{TravelTimeInSeconds: 600, TrafficDelayInSeconds: 300}
+	clear := Route{TravelTimeInSeconds: 600}
+
+	if ttl := trafficTTL(moving, 300, midday); ttl != 300 {
+		t.Errorf("Fail: expected the base ttl at midday, got %d", ttl)
+	}
+	if ttl := trafficTTL(jammed, 300, rushHour); ttl != 75 {
+		t.Errorf("Fail: expected a jam at rush hour to refresh in 75s, got %d", ttl)
+	}
+	if ttl := trafficTTL(clear, 300, night); ttl != 1800 {
+		t.Errorf("Fail: expected a clear road at night to keep 1800s, got %d", ttl)
+	}
+
+	// Clamped, unless the base is already outside the bounds
+	if ttl := trafficTTL(jammed, 100, rushHour); ttl != int32(ROUTE_MIN_TTL) {
+		t.Errorf("Fail: expected the ttl clamped to %f, got %d", ROUTE_MIN_TTL, ttl)
+	}
+	if ttl := trafficTTL(clear, 1200, night); ttl != int32(ROUTE_MAX_TTL) {
+		t.Errorf("Fail: expected the ttl clamped to %f, got %d", ROUTE_MAX_TTL, ttl)
+	}
+	if ttl := trafficTTL(jammed, 30, rushHour); ttl != 30 {
+		t.Errorf("Fail: expected a base under the minimum to stay put, got %d", ttl)
+	}
+}
+
+func TestTomTomRouteTTL(t *testing.T) {
+	t.Setenv("TT_TTL", "")
+	t.Setenv("TT_STALE_TTL", "120")
+	fresh, stale := TomTomRouteTTL(time.Date(2024, 6, 4, 17, 0, 0, 0, time.FixedZone("CDT", -5*60*60)))(Route{TravelTimeInSeconds: 600, TrafficDelayInSeconds: 60})
+	if fresh != 150 || stale != 120 {
+		t.Errorf("Fail: expected 150s fresh and 120s stale, got %d and %d", fresh, stale)
+	}
+}
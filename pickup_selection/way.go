@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Constant for km/h to mph (someMph := someKmh * KmhToMph)
+const KmhToMph float64 = 0.621371
+
+// A street from OpenStreetMap: its geometry, the raw OSM tags, and the tags we use parsed out
+type Way struct {
+	ID       int64             `json:"id"`
+	Geometry []Location        `json:"geometry"`
+	Tags     map[string]string `json:"tags"`
+
+	// Parsed from Tags by NewWay (not cached, so old cache entries still parse)
+	Name     string  `json:"-"`
+	Highway  string  `json:"-"`
+	Oneway   int     `json:"-"` // 1 = along the node order, -1 = against it, 0 = two-way
+	Lanes    int     `json:"-"` // 0 if unknown
+	MaxSpeed float64 `json:"-"` // in mph, 0 if unknown
+	Sidewalk string  `json:"-"` // "both", "left", "right", "separate", "no", or "" if unknown
+}
+
+// Function to build a Way from OSM data, parsing the tags we use
+func NewWay(id int64, geometry []Location, tags map[string]string) Way {
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	way := Way{
+		ID:       id,
+		Geometry: geometry,
+		Tags:     tags,
+		Name:     tags["name"],
+		Highway:  tags["highway"],
+		Sidewalk: tags["sidewalk"],
+	}
+
+	// oneway=yes/-1, roundabouts are implicitly one-way
+	switch tags["oneway"] {
+	case "yes", "true", "1":
+		way.Oneway = 1
+	case "-1", "reverse":
+		way.Oneway = -1
+	default:
+		if tags["junction"] == "roundabout" {
+			way.Oneway = 1
+		}
+	}
+
+	// lanes=2
+	if lanes, err := strconv.Atoi(strings.TrimSpace(tags["lanes"])); err == nil {
+		way.Lanes = lanes
+	}
+
+	way.MaxSpeed = parseMaxSpeed(tags["maxspeed"])
+
+	return way
+}
+
+// Helper function to parse an OSM maxspeed tag ("30 mph", "50" km/h) into mph (0 if unknown)
+func parseMaxSpeed(value string) float64 {
+	value = strings.TrimSpace(value)
+	isMph := strings.HasSuffix(value, "mph")
+	value = strings.TrimSpace(strings.TrimSuffix(value, "mph"))
+
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	if isMph {
+		return speed
+	}
+	return speed * KmhToMph
+}
+
+// Constant for how good a pickup spot each road class is (1 = best)
+var ROAD_CLASS_SCORES map[string]float64 = map[string]float64{
+	"residential":  1.0,
+	"unclassified": 0.9,
+	"tertiary":     0.8,
+	"service":      0.7,
+	"secondary":    0.6,
+	"primary":      0.4,
+}
+
+// Function to score how good a street is to be picked up on, in (0, 1].
+// Quiet, narrow, slow streets with sidewalks beat busy multi-lane arterials.
+func scoreWay(way Way) float64 {
+	// Start from the road class
+	score, ok := ROAD_CLASS_SCORES[way.Highway]
+	if !ok {
+		score = 0.5
+	}
+
+	// Each lane past 2 makes pulling over harder
+	if way.Lanes > 2 {
+		score *= math.Pow(0.85, float64(way.Lanes-2))
+	}
+
+	// Fast traffic makes pulling over dangerous
+	if way.MaxSpeed > 35 {
+		score *= 0.7
+	}
+
+	// No sidewalk means walking in the road
+	if way.Sidewalk == "no" || way.Sidewalk == "none" {
+		score *= 0.8
+	}
+
+	return score
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestNewWay(t *testing.T) {
+	way := NewWay(42, nil, map[string]string{
+		"name":     "Texas Avenue",
+		"highway":  "primary",
+		"oneway":   "-1",
+		"lanes":    "3",
+		"maxspeed": "45 mph",
+		"sidewalk": "both",
+	})
+
+	if way.ID != 42 || way.Name != "Texas Avenue" || way.Highway != "primary" || way.Sidewalk != "both" {
+		t.Errorf("Fail: tags were not parsed correctly, got %+v", way)
+	}
+	if way.Oneway != -1 || way.Lanes != 3 || way.MaxSpeed != 45 {
+		t.Errorf("Fail: numeric tags were not parsed correctly, got %+v", way)
+	}
+}
+
+func TestParseMaxSpeed(t *testing.T) {
+	if response := parseMaxSpeed("30 mph"); response != 30 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 30.0)
+	}
+	if response := parseMaxSpeed("50"); response != 50*KmhToMph {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 50*KmhToMph)
+	}
+	if response := parseMaxSpeed("signals"); response != 0 {
+		t.Errorf("Result was incorrect, got: %f, want: %f", response, 0.0)
+	}
+}
+
+func TestScoreWay(t *testing.T) {
+	residential := NewWay(1, nil, map[string]string{"highway": "residential", "maxspeed": "25 mph"})
+	arterial := NewWay(2, nil, map[string]string{"highway": "primary", "lanes": "6", "maxspeed": "45 mph"})
+
+	if scoreWay(residential) <= scoreWay(arterial) {
+		t.Errorf("Fail: residential street should beat a 6-lane primary, got %f <= %f", scoreWay(residential), scoreWay(arterial))
+	}
+}